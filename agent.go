@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgent provides the keys held by an ssh-agent. The connection to the
+// agent is re-established when it breaks, e.g. after the agent has been
+// restarted.
+type sshAgent struct {
+	socket string
+	conn   net.Conn
+	client agent.ExtendedAgent
+	mtx    sync.Mutex
+}
+
+func newSSHAgent(socket string) *sshAgent {
+	return &sshAgent{socket: socket}
+}
+
+// Signers returns the signers of all keys held by the agent.
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for retried := false; ; retried = true {
+		if a.client == nil {
+			conn, err := net.Dial("unix", a.socket)
+			if err != nil {
+				return nil, err
+			}
+			a.conn = conn
+			a.client = agent.NewClient(conn)
+		}
+
+		signers, err := a.client.Signers()
+		if err == nil || retried {
+			return signers, err
+		}
+
+		// connection broken, try again with a new one
+		a.conn.Close()
+		a.conn = nil
+		a.client = nil
+	}
+}
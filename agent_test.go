@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent serves the keyring on a Unix socket until the returned
+// listener is closed.
+func serveAgent(t *testing.T, socket string, keyring agent.Agent) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return listener
+}
+
+func TestSSHAgent(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	id, err := loadIdentity("fixtures/id_ed25519")
+	require.NoError(err)
+	signer := id.signer
+
+	keyring := agent.NewKeyring()
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	sshAgent := newSSHAgent(socket)
+
+	// agent not running
+	_, err = sshAgent.Signers()
+	assert.ErrorContains(err, "no such file or directory")
+
+	listener := serveAgent(t, socket, keyring)
+	signers, err := sshAgent.Signers()
+	require.NoError(err)
+	assert.Empty(signers)
+
+	// restart agent with a key
+	listener.Close()
+	sshAgent.conn.Close() // the listener doesn't close established connections
+	buf, err := os.ReadFile("fixtures/id_ed25519")
+	require.NoError(err)
+	rawKey, err := ssh.ParseRawPrivateKey(buf)
+	require.NoError(err)
+	require.NoError(keyring.Add(agent.AddedKey{PrivateKey: rawKey}))
+
+	listener = serveAgent(t, socket, keyring)
+	defer listener.Close()
+
+	signers, err = sshAgent.Signers()
+	require.NoError(err)
+	require.Len(signers, 1)
+	assert.Equal(signer.PublicKey().Marshal(), signers[0].PublicKey().Marshal())
+}
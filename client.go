@@ -1,25 +1,91 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type client struct {
 	key        clientKey
-	sshCert    *ssh.Certificate
-	sshConfig  ssh.ClientConfig
-	sshClient  *ssh.Client
+	addr       string        // address of the SSH server
+	user       string        // SSH username, empty for the default
+	host       sshHostConfig // settings from the OpenSSH configuration
+	proxy      *Proxy
+	tlsConfigs tlsConfigs
 	httpClient *http.Client
-	mtx        sync.Mutex
+	parent     *client // previous hop, if any
+
+	// protected by mtx, which is never held during network I/O
+	mtx       sync.Mutex
+	conns     []*sshConn
+	released  chan struct{} // closed when a channel or connection is released
+	sshCert   *ssh.Certificate
+	handshake *handshake   // in progress, if any
+	hostKeys  *keyring     // host specific private keys
+	settings  *sshSettings // settings the host keys were loaded for
+	failures  int          // consecutive failed handshakes
+	retryAt   time.Time    // circuit is open until then
+	tokens    float64      // remaining retry budget
+	refilled  time.Time    // last update of tokens
+
+	// protected by Proxy.mtx
+	active   int       // number of requests using this client
+	lastUsed time.Time // time of the last acquire or release
+}
+
+// Circuit breaker states. After a failed handshake, the circuit is open
+// and requests fail immediately. Once the backoff has passed, it is
+// half-open and a single handshake is tried, which closes it on success.
+const (
+	circuitClosed = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+// sshConn is a pooled SSH connection.
+type sshConn struct {
+	*ssh.Client
+	channels int // open or reserved channels, protected by client.mtx
+}
+
+// forwardedConn is a connection through SSH, which releases its channel
+// when closed.
+type forwardedConn struct {
+	net.Conn
+	ssh     *sshConn
+	release func()
+	once    sync.Once
+}
+
+func (conn *forwardedConn) Close() error {
+	conn.once.Do(conn.release)
+	return conn.Conn.Close()
+}
+
+// handshake is an SSH handshake in progress. Concurrent requests for the
+// same client wait for it and share its result.
+type handshake struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int // protected by client.mtx
+	conn    *sshConn
+	err     error
 }
 
 // clientKey is used for reusing SSH connections.
@@ -27,6 +93,8 @@ type clientKey struct {
 	host     string
 	port     uint16
 	username string
+	password string // for SSH password authentication, never printed
+	jump     string // previous hops, separated by commas
 }
 
 // hostPort returns the host joined with the port.
@@ -34,72 +102,585 @@ func (key *clientKey) hostPort() string {
 	return net.JoinHostPort(key.host, strconv.Itoa(int(key.port)))
 }
 
+// String returns the key in the form "[jump,][user@]host:port". The
+// password is omitted, so it is safe for logs and metric labels.
 func (key *clientKey) String() string {
-	hp := key.hostPort()
-	if key.username == "" {
-		return hp
+	hop := key.hostPort()
+	if key.username != "" {
+		hop = fmt.Sprintf("%s@%s", key.username, hop)
+	}
+	if key.jump == "" {
+		return hop
+	}
+	return key.jump + "," + hop
+}
+
+// parent returns the key of the previous hop.
+func (key *clientKey) parent() (clientKey, bool) {
+	if key.jump == "" {
+		return clientKey{}, false
+	}
+
+	jump, last := "", key.jump
+	if i := strings.LastIndexByte(key.jump, ','); i != -1 {
+		jump, last = key.jump[:i], key.jump[i+1:]
+	}
+
+	parent, err := parseHop(last)
+	if err != nil {
+		return clientKey{}, false
+	}
+	parent.jump = jump
+	return parent, true
+}
+
+// parseHop parses a single SSH hop in the form "[user@]host[:port]".
+func parseHop(hop string) (clientKey, error) {
+	var key clientKey
+	if i := strings.LastIndexByte(hop, '@'); i != -1 {
+		key.username, hop = hop[:i], hop[i+1:]
+	}
+
+	host, port, err := net.SplitHostPort(hop)
+	if err != nil {
+		// no port given
+		host, port = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"), ""
+	}
+	if host == "" {
+		return clientKey{}, fmt.Errorf("parsing %q: host missing", hop)
+	}
+	key.host = host
+
+	key.port, err = parsePort(port)
+	if err != nil {
+		return clientKey{}, err
+	}
+
+	return key, nil
+}
+
+// parseHopChain parses "[user@]host[:port]", optionally preceded by
+// comma-separated jump hosts.
+func parseHopChain(s string) (clientKey, error) {
+	hops := strings.Split(s, ",")
+	jump, err := parseJumpHosts(hops[:len(hops)-1])
+	if err != nil {
+		return clientKey{}, err
+	}
+
+	key, err := parseHop(hops[len(hops)-1])
+	if err != nil {
+		return clientKey{}, err
+	}
+	key.jump = jump
+	return key, nil
+}
+
+// parsePort parses a port number. An empty port results in the default
+// SSH port.
+func parsePort(port string) (uint16, error) {
+	if port == "" {
+		return defaultPort, nil
+	}
+
+	ui, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("parsing \"%v\": invalid port number", port)
 	}
-	return fmt.Sprintf("%s@%s", key.username, hp)
+	return uint16(ui), nil
+}
+
+// unixSocketSuffix marks hostnames which encode the path of a Unix domain
+// socket on the destination host. The ".invalid" TLD is reserved and
+// can never collide with a real hostname.
+const unixSocketSuffix = ".unix.invalid"
+
+// unixSocketHost encodes a socket path into a hostname, so that the HTTP
+// transport keeps separate connection pools for each socket.
+func unixSocketHost(path string) string {
+	return hex.EncodeToString([]byte(path)) + unixSocketSuffix
 }
 
-// establishes the SSH connection and sets up the HTTP client.
-func (client *client) connect() error {
-	sshClient, err := ssh.Dial("tcp", client.key.hostPort(), &client.sshConfig)
+// unixSocketPath returns the socket path encoded in the given host or
+// host:port address.
+func unixSocketPath(address string) (string, bool) {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+
+	encoded, ok := strings.CutSuffix(host, unixSocketSuffix)
+	if !ok {
+		return "", false
+	}
+
+	path, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+// clientConfig returns the SSH client configuration for a new connection,
+// based on the current settings of the proxy. The caller must hold
+// client.mtx.
+func (client *client) clientConfig() *ssh.ClientConfig {
+	settings := client.proxy.sshConfig.Load()
+	config := settings.config // make copy
+	if client.user != "" {
+		config.User = client.user
+	}
+
+	// (re-)load the host specific keys along with the default keys
+	if settings != client.settings {
+		var identities []string
+		for _, file := range client.host.IdentityFiles {
+			identities = append(identities, client.host.expandTokens(file, client.key.host, config.User))
+		}
+		client.hostKeys = newKeyring(identities...)
+		client.settings = settings
+	}
+
+	config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if err := settings.config.HostKeyCallback(hostname, remote, key); err != nil {
+			return err
+		}
+		if cert, ok := key.(*ssh.Certificate); ok && cert != nil {
+			client.mtx.Lock()
+			client.sshCert = cert
+			client.mtx.Unlock()
+		}
+		return nil
+	}
+
+	// host specific keys are tried first
+	if auth := publicKeys(client.hostKeys, settings.keys, client.proxy.agent); auth != nil {
+		config.Auth = append([]ssh.AuthMethod{auth}, settings.config.Auth...)
+	}
+	if client.key.password != "" {
+		config.Auth = append(config.Auth, passwordAuthMethods(client.key.password)...)
+	}
+
+	return &config
+}
+
+// acquire returns the least loaded SSH connection and reserves a channel
+// on it, until passed to release. If all connections are in use, another
+// one is established in the background, up to the maximum number of
+// connections. Callers wait only if all connections have reached the
+// maximum number of channels.
+//
+// Only one handshake runs at a time, concurrent callers wait for it. The
+// handshake is aborted once all waiting callers have given up.
+//
+// Idle HTTP connections hold a channel as well. They are closed once the
+// maximum number of channels is reached, before callers wait for a free
+// channel.
+func (client *client) acquire(ctx context.Context) (*sshConn, error) {
+	maxConns, maxChannels := max(client.proxy.maxConns, 1), client.proxy.maxChannels
+	closedIdle := false
+
+	for {
+		client.mtx.Lock()
+		conn := client.leastLoaded()
+
+		full := conn != nil && maxChannels > 0 && conn.channels >= maxChannels
+		if !closedIdle && full {
+			client.mtx.Unlock()
+			client.closeIdleConnections()
+			closedIdle = true
+			continue
+		}
+
+		hs := client.handshake
+		if hs == nil && len(client.conns) < maxConns && (conn == nil || conn.channels > 0) {
+			if client.circuitState() != circuitOpen {
+				hs = client.startHandshake()
+			} else if conn == nil {
+				err := fmt.Errorf("%w for %s after %d failed connection attempts, retrying in %v",
+					errCircuitOpen, client.key.String(), client.failures, time.Until(client.retryAt).Round(time.Millisecond))
+				client.mtx.Unlock()
+				return nil, err
+			}
+		}
+
+		if conn != nil && (maxChannels <= 0 || conn.channels < maxChannels) {
+			conn.channels++
+			client.mtx.Unlock()
+			return conn, nil
+		}
+
+		if hs == nil {
+			// wait for a free channel
+			released := client.released
+			client.mtx.Unlock()
+			select {
+			case <-released:
+				continue
+			case <-ctx.Done():
+				return nil, context.Cause(ctx)
+			}
+		}
+
+		hs.waiters++
+		client.mtx.Unlock()
+
+		select {
+		case <-hs.done:
+			if hs.err != nil && !client.isConnected() {
+				return nil, hs.err
+			}
+		case <-ctx.Done():
+			client.mtx.Lock()
+			hs.waiters--
+			if hs.waiters == 0 {
+				hs.cancel()
+			}
+			client.mtx.Unlock()
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// release frees a channel reserved by acquire.
+func (client *client) release(conn *sshConn) {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	conn.channels--
+	client.notifyReleased()
+}
+
+// notifyReleased wakes up callers waiting for a free channel. The caller
+// must hold client.mtx.
+func (client *client) notifyReleased() {
+	if client.released != nil {
+		close(client.released)
+	}
+	client.released = make(chan struct{})
+}
+
+// leastLoaded returns the connection with the fewest channels, if any.
+// The caller must hold client.mtx.
+func (client *client) leastLoaded() *sshConn {
+	var least *sshConn
+	for _, conn := range client.conns {
+		if least == nil || conn.channels < least.channels {
+			least = conn
+		}
+	}
+	return least
+}
+
+// startHandshake starts establishing another SSH connection. The caller
+// must hold client.mtx.
+func (client *client) startHandshake() *handshake {
+	if client.released == nil {
+		client.released = make(chan struct{})
+	}
+
+	var ctx context.Context
+	hs := &handshake{done: make(chan struct{})}
+	ctx, hs.cancel = context.WithCancel(context.Background())
+	client.handshake = hs
+	go client.runHandshake(ctx, hs, client.clientConfig())
+	return hs
+}
+
+// runHandshake establishes the SSH connection, adds it to the pool and
+// passes the result to the callers waiting for it.
+func (client *client) runHandshake(ctx context.Context, hs *handshake, config *ssh.ClientConfig) {
+	defer hs.cancel()
+
+	sshClient, err := client.connect(ctx, config)
+
+	client.mtx.Lock()
+	client.handshake = nil
+	switch {
+	case err == nil:
+		hs.conn = &sshConn{Client: sshClient}
+		client.conns = append(client.conns, hs.conn)
+		client.failures = 0
+	case ctx.Err() == nil:
+		// an aborted handshake says nothing about the host
+		client.failures++
+		client.retryAt = time.Now().Add(client.proxy.backoffDelay(client.failures))
+	}
+	hs.err = err
+	client.mtx.Unlock()
+	close(hs.done)
+
+	if err == nil {
+		go client.keepalive(hs.conn)
+	}
+}
+
+// circuitState returns the state of the circuit breaker. The caller must
+// hold client.mtx.
+func (client *client) circuitState() int {
+	switch {
+	case client.failures == 0:
+		return circuitClosed
+	case time.Now().Before(client.retryAt):
+		return circuitOpen
+	default:
+		return circuitHalfOpen
+	}
+}
+
+// keepalive sends keepalive requests until the connection is closed. The
+// connection is discarded when it is closed by the server or when too many
+// replies are missing.
+func (client *client) keepalive(conn *sshConn) {
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Wait()
+		close(closed)
+	}()
+
+	var tick <-chan time.Time
+	if interval := client.proxy.keepaliveInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	for {
+		select {
+		case <-closed:
+			if client.discard(conn) {
+				log.Printf("SSH connection to %s closed by remote", client.key.String())
+			}
+			return
+
+		case err := <-replies:
+			pending = false
+			missed = 0
+			if err != nil {
+				client.keepaliveFailed(conn, err)
+				return
+			}
+
+		case <-tick:
+			if pending {
+				missed++
+				if missed >= max(client.proxy.keepaliveCount, 1) {
+					client.keepaliveFailed(conn, fmt.Errorf("%d keepalives unanswered", missed))
+					return
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
+
+func (client *client) keepaliveFailed(conn *sshConn, err error) {
+	if client.discard(conn) {
+		metrics.connections.dead++
+		log.Printf("SSH connection to %s is dead: %v", client.key.String(), err)
+	}
+}
+
+// establishes the SSH connection.
+func (client *client) connect(ctx context.Context, config *ssh.ClientConfig) (*ssh.Client, error) {
+	sshClient, err := client.dialSSH(ctx, config)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("SSH connection to %s aborted: %v", client.key.String(), err)
+		return nil, err
+	}
 	if err != nil {
 		metrics.connections.failed++
 		log.Printf("SSH connection to %s failed: %v", client.key.String(), err)
-		return err
+		return nil, err
 	}
 
-	client.sshClient = sshClient
 	metrics.connections.established++
 	log.Printf("SSH connection to %s established", client.key.String())
 
-	return nil
+	return sshClient, nil
 }
 
-// establishes a TCP connection through SSH.
-func (client *client) dial(network, address string) (net.Conn, error) {
-	client.mtx.Lock()
-	defer client.mtx.Unlock()
+// dials the SSH server, either directly or through the previous hop. The
+// timeout of the configuration applies to the whole handshake.
+func (client *client) dialSSH(ctx context.Context, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if timeout := config.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-	retried := false
+	addr := client.addr
+	var conn net.Conn
+	var err error
+	if client.parent == nil {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = client.parent.dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-retry:
-	if client.sshClient == nil {
-		if err := client.connect(); err != nil {
-			return nil, err
+	// forwarded connections don't support deadlines
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		if errors.Is(context.Cause(ctx), context.DeadlineExceeded) {
+			err = fmt.Errorf("ssh: handshake with %s timed out", addr)
+		} else {
+			err = context.Cause(ctx)
 		}
 	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-	conn, err := client.sshClient.Dial(network, address)
+	return ssh.NewClient(c, chans, reqs), nil
+}
 
-	if err != nil && !retried && (errors.Is(err, io.EOF) || !client.isAlive()) {
-		// ssh connection broken
-		client.sshClient.Close()
-		client.sshClient = nil
+// establishes a TCP connection or a connection to a Unix domain socket
+// through SSH.
+func (client *client) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	kind := "TCP"
+	if path, ok := unixSocketPath(address); ok {
+		kind = "Unix socket"
+		network = "unix"
+		address = path
+	}
 
-		// Clean up idle HTTP connections
-		client.httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	retried := false
+
+retry:
+	sshConn, err := client.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sshConn.DialContext(ctx, network, address)
+	if err != nil {
+		client.release(sshConn)
+	}
 
+	if err != nil && !retried && ctx.Err() == nil && (errors.Is(err, io.EOF) || !isAlive(sshConn.Client)) {
+		// ssh connection broken
+		client.discard(sshConn)
 		retried = true
 		goto retry
 	}
 
-	if err == nil {
-		metrics.forwardings.established++
-		log.Printf("TCP forwarding via %s to %s established", client.key.String(), address)
-	} else {
+	if err != nil {
 		metrics.forwardings.failed++
-		log.Printf("TCP forwarding via %s to %s failed: %s", client.key.String(), address, err)
+		log.Printf("%s forwarding via %s to %s failed: %s", kind, client.key.String(), address, err)
+		return nil, err
+	}
+
+	metrics.forwardings.established++
+	log.Printf("%s forwarding via %s to %s established", kind, client.key.String(), address)
+
+	return &forwardedConn{Conn: conn, ssh: sshConn, release: func() { client.release(sshConn) }}, nil
+}
+
+// hops returns the number of jump hosts in front of the client.
+func (client *client) hops() int {
+	n := 0
+	for parent := client.parent; parent != nil; parent = parent.parent {
+		n++
+	}
+	return n
+}
+
+// closes the SSH connections and idle HTTP connections.
+func (client *client) close() {
+	client.mtx.Lock()
+	conns := client.conns
+	client.conns = nil
+	client.notifyReleased()
+	client.mtx.Unlock()
+
+	client.closeIdleConnections()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// discard closes a broken SSH connection and reports whether it was still
+// in the pool, i.e. not yet closed by someone else.
+func (client *client) discard(conn *sshConn) bool {
+	client.mtx.Lock()
+	i := slices.Index(client.conns, conn)
+	if i != -1 {
+		client.conns = slices.Delete(client.conns, i, i+1)
+		client.notifyReleased()
+	}
+	client.mtx.Unlock()
+
+	conn.Close()
+
+	// Clean up idle HTTP connections
+	client.closeIdleConnections()
+
+	return i != -1
+}
+
+// closeIdleConnections closes idle HTTP connections, which releases their
+// channels.
+func (client *client) closeIdleConnections() {
+	client.httpClient.Transport.(*http.Transport).CloseIdleConnections()
+}
+
+// isConnected checks whether an SSH connection is established.
+func (client *client) isConnected() bool {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	return len(client.conns) > 0
+}
+
+// establishes a TLS connection through SSH.
+func (client *client) dialTLS(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := client.dial(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(address)
+	if _, ok := unixSocketPath(host); ok {
+		host = "localhost"
+	}
+
+	if timeout := client.proxy.sshConfig.Load().config.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, client.tlsConfigs.forHost(host))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		log.Printf("TLS handshake via %s with %s failed: %v", client.key.String(), address, err)
+		return nil, err
 	}
 
-	return conn, err
+	return tlsConn, nil
 }
 
 // checks if the SSH client is still alive by sending a keep alive request.
-func (client *client) isAlive() bool {
-	_, _, err := client.sshClient.Conn.SendRequest("keepalive@openssh.com", true, nil)
+func isAlive(sshClient *ssh.Client) bool {
+	_, _, err := sshClient.Conn.SendRequest("keepalive@openssh.com", true, nil)
 
 	return err == nil
 }
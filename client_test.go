@@ -2,12 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestParseRequest(t *testing.T) {
@@ -63,6 +72,46 @@ func TestParseRequest(t *testing.T) {
 			expectedKey: clientKey{host: "fe80::1", port: 2222},
 			expectedURI: "http://[fe80::2]:9100/metrics",
 		},
+		{
+			name:        "Jump host",
+			requestURI:  "http://bastion,inner:2222/localhost:9100/metrics",
+			expectedKey: clientKey{host: "inner", port: 2222, jump: "bastion:22"},
+			expectedURI: "http://localhost:9100/metrics",
+		},
+		{
+			name:          "Multiple jump hosts with users and ports",
+			requestURI:    "http://admin@bastion:2200,[fe80::1],inner/localhost:9100/metrics",
+			authorization: "Basic cHJvbWV0aGV1czo=",
+			expectedKey:   clientKey{host: "inner", port: 22, username: "prometheus", jump: "admin@bastion:2200,[fe80::1]:22"},
+			expectedURI:   "http://localhost:9100/metrics",
+		},
+		{
+			name:          "Invalid jump host port",
+			requestURI:    "http://bastion:99999,inner/localhost",
+			expectedError: "invalid jump host: parsing \"99999\": invalid port number",
+		},
+		{
+			name:          "Empty jump host",
+			requestURI:    "http://,inner/localhost",
+			expectedError: "invalid jump host: parsing \"\": host missing",
+		},
+		{
+			name:        "Unix socket with path",
+			requestURI:  "http://example.com/unix:/run/foo.sock:/metrics?foo=bar",
+			expectedKey: clientKey{host: "example.com", port: 22},
+			expectedURI: "http://" + unixSocketHost("/run/foo.sock") + "/metrics?foo=bar",
+		},
+		{
+			name:        "Unix socket without path",
+			requestURI:  "http://example.com/unix:/run/foo.sock",
+			expectedKey: clientKey{host: "example.com", port: 22},
+			expectedURI: "http://" + unixSocketHost("/run/foo.sock") + "/",
+		},
+		{
+			name:          "Unix socket without socket path",
+			requestURI:    "http://example.com/unix::/metrics",
+			expectedError: "socket path missing in request URI",
+		},
 	}
 
 	for _, test := range tests {
@@ -92,6 +141,22 @@ func TestParseRequest(t *testing.T) {
 	}
 }
 
+func TestUnixSocketPath(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	path, ok := unixSocketPath(unixSocketHost("/run/foo.sock") + ":80")
+	assert.True(ok)
+	assert.Equal("/run/foo.sock", path)
+
+	_, ok = unixSocketPath("localhost:80")
+	assert.False(ok)
+
+	_, ok = unixSocketPath("zz" + unixSocketSuffix)
+	assert.False(ok)
+}
+
 func TestClientKeyToString(t *testing.T) {
 	t.Parallel()
 
@@ -112,6 +177,16 @@ func TestClientKeyToString(t *testing.T) {
 			input:    clientKey{host: "example.com", port: 22, username: "prometheus"},
 			expected: "prometheus@example.com:22",
 		},
+		{
+			name:     "host with username and password",
+			input:    clientKey{host: "example.com", port: 22, username: "prometheus", password: "secret"},
+			expected: "prometheus@example.com:22",
+		},
+		{
+			name:     "host with jump hosts",
+			input:    clientKey{host: "example.com", port: 22, jump: "admin@bastion:22,[fe80::1]:2222"},
+			expected: "admin@bastion:22,[fe80::1]:2222,example.com:22",
+		},
 	}
 
 	for _, test := range tests {
@@ -122,41 +197,218 @@ func TestClientKeyToString(t *testing.T) {
 	}
 }
 
+func TestClientKeyParent(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	key := clientKey{host: "example.com", port: 22, jump: "admin@bastion:22,[fe80::1]:2222"}
+
+	parent, ok := key.parent()
+	assert.True(ok)
+	assert.Equal(clientKey{host: "fe80::1", port: 2222, jump: "admin@bastion:22"}, parent)
+
+	parent, ok = parent.parent()
+	assert.True(ok)
+	assert.Equal(clientKey{host: "bastion", port: 22, username: "admin"}, parent)
+
+	_, ok = parent.parent()
+	assert.False(ok)
+}
+
+func TestParseHopChain(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	key, err := parseHopChain("prometheus@example.com")
+	assert.NoError(err)
+	assert.Equal(clientKey{host: "example.com", port: 22, username: "prometheus"}, key)
+
+	key, err = parseHopChain("admin@bastion:2200,[fe80::1],inner:2222")
+	assert.NoError(err)
+	assert.Equal(clientKey{host: "inner", port: 2222, jump: "admin@bastion:2200,[fe80::1]:22"}, key)
+
+	_, err = parseHopChain("bastion,")
+	assert.EqualError(err, `parsing "": host missing`)
+
+	_, err = parseHopChain(",inner")
+	assert.EqualError(err, `invalid jump host: parsing "": host missing`)
+}
+
 func TestGetClient(t *testing.T) {
 	t.Parallel()
 
 	assert := assert.New(t)
 
 	proxy := NewProxy()
-	proxy.sshConfig.User = "default"
+	proxy.sshConfig.Store(&sshSettings{config: ssh.ClientConfig{User: "default"}})
 
 	// default username
 	{
 		client := proxy.getClient(clientKey{host: "::1"})
-		assert.Equal("default", client.sshConfig.User)
+		assert.Equal("default", client.clientConfig().User)
 	}
 
 	// override username
 	{
 		client := proxy.getClient(clientKey{host: "::1", username: "prometheus"})
-		assert.Equal("prometheus", client.sshConfig.User)
+		assert.Equal("prometheus", client.clientConfig().User)
 	}
 }
 
-func TestClientDialHTTPS(t *testing.T) {
+func TestClientConfigReload(t *testing.T) {
 	t.Parallel()
 
 	assert := assert.New(t)
 
+	identityFile, err := filepath.Abs("fixtures/id_ed25519")
+	require.NoError(t, err)
+
+	file := writeSSHConfig(t, map[string]string{
+		"config": "Host web\n  IdentityFile " + identityFile + "\n",
+	})
+	hosts, err := readSSHConfig(file)
+	require.NoError(t, err)
+
 	proxy := NewProxy()
-	client := proxy.getClient(clientKey{host: "::1"})
+	proxy.hosts = hosts
+	proxy.sshConfig.Store(&sshSettings{config: ssh.ClientConfig{User: "old"}})
 
-	response, err := client.httpClient.Get("https://example.com/")
-	assert.EqualError(err, `Get "https://example.com/": not implemented`)
+	client := proxy.getClient(clientKey{host: "web", port: 22})
+	config := client.clientConfig()
+	hostKeys := client.hostKeys
+	assert.Equal("old", config.User)
+	assert.Equal(1, hostKeys.Len())
+	assert.Len(config.Auth, 1)
 
-	if response != nil {
-		response.Body.Close()
-	}
+	// unchanged settings keep the host keys
+	client.clientConfig()
+	assert.Same(hostKeys, client.hostKeys)
+
+	// reloaded settings
+	proxy.sshConfig.Store(&sshSettings{config: ssh.ClientConfig{User: "new"}})
+	assert.Equal("new", client.clientConfig().User)
+	assert.NotSame(hostKeys, client.hostKeys)
+}
+
+func TestGetClientWithSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	file := writeSSHConfig(t, map[string]string{
+		"config": `
+Host web
+  HostName web.internal
+  User admin
+  Port 2222
+  ProxyJump bastion
+`,
+	})
+	hosts, err := readSSHConfig(file)
+	require.NoError(t, err)
+
+	proxy := NewProxy()
+	proxy.hosts = hosts
+	proxy.sshConfig.Store(&sshSettings{config: ssh.ClientConfig{User: "default"}})
+
+	client := proxy.getClient(clientKey{host: "web", port: 22})
+	assert.Equal("web.internal:2222", client.addr)
+	assert.Equal("admin", client.clientConfig().User)
+	assert.Equal(clientKey{host: "bastion", port: 22}, client.parent.key)
+	assert.Equal("bastion:22", client.parent.addr)
+	assert.Equal("default", client.parent.clientConfig().User)
+
+	// explicit port and username take precedence
+	client = proxy.getClient(clientKey{host: "web", port: 2200, username: "prometheus"})
+	assert.Equal("web.internal:2200", client.addr)
+	assert.Equal("prometheus", client.clientConfig().User)
+}
+
+func TestGetClientWithJumpHost(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	proxy := NewProxy()
+	bastion := clientKey{host: "bastion", port: 22}
+
+	first := proxy.getClient(clientKey{host: "inner1", port: 22, jump: "bastion:22"})
+	second := proxy.getClient(clientKey{host: "inner2", port: 22, jump: "bastion:22"})
+
+	assert.Len(proxy.clients, 3)
+	assert.Same(proxy.clients[bastion], first.parent)
+	assert.Same(proxy.clients[bastion], second.parent)
+	assert.Equal(2, first.parent.active)
+
+	// jump host is reaped after the clients depending on it
+	proxy.releaseClient(first)
+	proxy.releaseClient(second)
+	first.lastUsed = time.Now().Add(-time.Hour)
+	second.lastUsed = time.Now().Add(-time.Hour)
+
+	proxy.reapIdleClients(time.Minute)
+	assert.Len(proxy.clients, 1)
+	assert.Equal(0, proxy.clients[bastion].active)
+
+	proxy.clients[bastion].lastUsed = time.Now().Add(-time.Hour)
+	proxy.reapIdleClients(time.Minute)
+	assert.Empty(proxy.clients)
+}
+
+func TestReapIdleClients(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	proxy := NewProxy()
+	idle := proxy.getClient(clientKey{host: "::1", port: 22})
+	proxy.releaseClient(idle)
+	busy := proxy.getClient(clientKey{host: "::1", port: 2222})
+
+	idle.lastUsed = time.Now().Add(-time.Hour)
+	busy.lastUsed = time.Now().Add(-time.Hour)
+
+	proxy.reapIdleClients(time.Minute)
+	assert.NotContains(proxy.clients, idle.key)
+	assert.Contains(proxy.clients, busy.key)
+
+	// not yet idle for long enough
+	proxy.releaseClient(busy)
+	proxy.reapIdleClients(time.Minute)
+	assert.Contains(proxy.clients, busy.key)
+}
+
+func TestReapIdleConnectedClient(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+	defer proxy.close()
+
+	connected := proxy.getClient(clientKey{host: "127.0.0.1", port: sshPort})
+	conn, err := connected.acquire(context.Background())
+	require.NoError(err)
+	connected.release(conn)
+	proxy.releaseClient(connected)
+	unconnected := proxy.getClient(clientKey{host: "127.0.0.1", port: 1})
+	proxy.releaseClient(unconnected)
+
+	connected.lastUsed = time.Now().Add(-time.Hour)
+	unconnected.lastUsed = time.Now().Add(-time.Hour)
+
+	// only clients with SSH connections are counted
+	reaped := metrics.connections.reaped
+	proxy.reapIdleClients(time.Minute)
+	assert.Empty(proxy.clients)
+	assert.False(connected.isConnected())
+	assert.EqualValues(1, metrics.connections.reaped-reaped)
 }
 
 func TestInvalidRequestURI(t *testing.T) {
@@ -180,3 +432,461 @@ func TestInvalidRequestURI(t *testing.T) {
 	assert.Equal(400, res.StatusCode)
 	assert.Equal(`unable to parse URI: parse "%zz": invalid URL escape "%zz"`+"\n", string(body))
 }
+
+func TestPasswordAuth(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "admin" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+		KeyboardInteractiveCallback: func(c ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Username: ", "Password: "}, []bool{true, false})
+			if err != nil {
+				return nil, err
+			}
+			if c.User() == "appliance" && answers[0] == "" && answers[1] == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+
+	port := sshPort
+	connect := func(username, password string) (*client, error) {
+		client := proxy.getClient(clientKey{host: "127.0.0.1", port: port, username: username, password: password})
+		defer proxy.releaseClient(client)
+
+		if _, err := client.acquire(context.Background()); err != nil {
+			return nil, err
+		}
+		t.Cleanup(client.close)
+		return client, nil
+	}
+
+	// password
+	admin, err := connect("admin", "secret")
+	assert.NoError(err)
+	_, err = connect("admin", "wrong")
+	assert.Error(err)
+
+	// keyboard-interactive
+	appliance, err := connect("appliance", "secret")
+	assert.NoError(err)
+	_, err = connect("appliance", "wrong")
+	assert.Error(err)
+
+	assert.NotSame(admin, appliance)
+	assert.Len(proxy.clients, 4)
+}
+
+func TestPasswordAuthDisabled(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	for _, enabled := range []bool{false, true} {
+		proxy := NewProxy()
+		proxy.passwordAuth = enabled
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RequestURI = "http://127.0.0.1:1/localhost/metrics"
+		r.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		assert.Equal(http.StatusBadGateway, w.Code)
+
+		expected := clientKey{host: "127.0.0.1", port: 1, username: "admin"}
+		if enabled {
+			expected.password = "secret"
+		}
+		assert.Contains(proxy.clients, expected)
+		assert.NotContains(w.Body.String(), "secret")
+	}
+}
+
+func TestPasswordNotForwarded(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	sshPort := startSSHServer(t, &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	})
+
+	var authorization []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Values("Authorization")
+	}))
+	defer upstream.Close()
+
+	proxy := newTestProxy()
+	proxy.passwordAuth = true
+	defer proxy.close()
+
+	r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:"+strconv.Itoa(int(sshPort))+"/"+upstream.Listener.Addr().String()+"/metrics", nil)
+	r.SetBasicAuth("prometheus", "sshsecret")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(authorization)
+}
+
+func TestConcurrentHandshake(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var handshakes atomic.Int32
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			handshakes.Add(1)
+			time.Sleep(100 * time.Millisecond)
+			return nil, nil
+		},
+	}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+
+	key := clientKey{host: "127.0.0.1", port: sshPort, password: "secret"}
+	client := proxy.getClient(key)
+	defer proxy.releaseClient(client)
+	defer client.close()
+
+	const n = 10
+	results := make(chan *sshConn, n)
+	for range n {
+		go func() {
+			conn, err := client.acquire(context.Background())
+			assert.NoError(err)
+			results <- conn
+		}()
+	}
+
+	first := <-results
+	require.NotNil(first)
+	for range n - 1 {
+		assert.Same(first, <-results)
+	}
+	assert.EqualValues(1, handshakes.Load())
+
+	// the established connection is reused without blocking
+	conn, err := client.acquire(context.Background())
+	assert.NoError(err)
+	assert.Same(first, conn)
+	assert.Equal(n+1, first.channels)
+}
+
+func TestKeepalive(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	listener := listenSSH(t, config)
+
+	// replies to keepalives until told to hang
+	hang := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+		if err != nil {
+			return
+		}
+		defer sshConn.Close()
+		go func() {
+			for ch := range chans {
+				_ = ch.Reject(ssh.Prohibited, "no channels")
+			}
+		}()
+
+		for req := range reqs {
+			select {
+			case <-hang:
+			default:
+				_ = req.Reply(false, nil)
+			}
+		}
+	}()
+
+	proxy := newTestProxy()
+	proxy.keepaliveInterval = 20 * time.Millisecond
+	proxy.keepaliveCount = 2
+
+	client := proxy.getClient(clientKey{host: "127.0.0.1", port: uint16(listener.Addr().(*net.TCPAddr).Port)})
+	defer proxy.releaseClient(client)
+	defer client.close()
+
+	_, err := client.acquire(context.Background())
+	require.NoError(err)
+
+	// answered keepalives keep the connection
+	time.Sleep(100 * time.Millisecond)
+	assert.True(client.isConnected())
+
+	close(hang)
+	assert.Eventually(func() bool { return !client.isConnected() }, time.Second, 10*time.Millisecond)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	var accept atomic.Bool
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if accept.Load() {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+	proxy.backoff = 200 * time.Millisecond
+	proxy.maxBackoff = time.Second
+	proxy.passwordAuth = true
+
+	key := clientKey{host: "127.0.0.1", port: sshPort, password: "secret"}
+	client := proxy.getClient(key)
+	defer proxy.releaseClient(client)
+	defer client.close()
+
+	state := func() int {
+		client.mtx.Lock()
+		defer client.mtx.Unlock()
+		return client.circuitState()
+	}
+
+	_, err := client.acquire(context.Background())
+	assert.ErrorContains(err, "unable to authenticate")
+	assert.Equal(circuitOpen, state())
+
+	// fails fast
+	_, err = client.acquire(context.Background())
+	assert.ErrorIs(err, errCircuitOpen)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RequestURI = "http://127.0.0.1:" + strconv.Itoa(int(key.port)) + "/localhost/metrics"
+	r.SetBasicAuth("", "secret")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(http.StatusBadGateway, w.Code)
+	assert.Contains(w.Body.String(), "circuit open for 127.0.0.1:")
+
+	// half-open probe closes the circuit
+	accept.Store(true)
+	assert.Eventually(func() bool { return state() == circuitHalfOpen }, time.Second, 10*time.Millisecond)
+	_, err = client.acquire(context.Background())
+	assert.NoError(err)
+	assert.Equal(circuitClosed, state())
+}
+
+func TestBackoffDelay(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	proxy := Proxy{backoff: time.Second, maxBackoff: 5 * time.Second}
+	assert.Equal(time.Second, proxy.backoffDelay(1))
+	assert.Equal(2*time.Second, proxy.backoffDelay(2))
+	assert.Equal(4*time.Second, proxy.backoffDelay(3))
+	assert.Equal(5*time.Second, proxy.backoffDelay(4))
+	assert.Equal(5*time.Second, proxy.backoffDelay(1000))
+}
+
+func TestHandshakeCancellation(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			<-release
+			return nil, errors.New("access denied")
+		},
+	}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+	proxy.passwordAuth = true
+	proxy.backoff = time.Minute
+	proxy.sshConfig.Load().config.Timeout = 10 * time.Second
+
+	key := clientKey{host: "127.0.0.1", port: sshPort, password: "secret"}
+
+	// scrape timeout
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RequestURI = "http://127.0.0.1:" + strconv.Itoa(int(sshPort)) + "/localhost/metrics"
+	r.SetBasicAuth("", "secret")
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "0.2")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	proxy.ServeHTTP(w, r)
+	assert.Equal(http.StatusBadGateway, w.Code)
+	assert.Contains(w.Body.String(), "context deadline exceeded")
+	assert.Less(time.Since(start), 2*time.Second)
+
+	// cancelled context
+	client := proxy.getClient(key)
+	defer proxy.releaseClient(client)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err := client.acquire(ctx)
+	assert.ErrorIs(err, context.Canceled)
+
+	// aborted handshakes don't open the circuit
+	assert.Eventually(func() bool {
+		client.mtx.Lock()
+		defer client.mtx.Unlock()
+		return client.handshake == nil
+	}, time.Second, 10*time.Millisecond)
+	client.mtx.Lock()
+	assert.Equal(circuitClosed, client.circuitState())
+	client.mtx.Unlock()
+}
+
+func TestConnectionPool(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var handshakes atomic.Int32
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			handshakes.Add(1)
+			return nil, nil
+		},
+	}
+	sshPort := startSSHServer(t, config)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer target.Close()
+
+	proxy := newTestProxy()
+	proxy.maxConns = 2
+	proxy.maxChannels = 1
+
+	key := clientKey{host: "127.0.0.1", port: sshPort, password: "secret"}
+	client := proxy.getClient(key)
+	defer proxy.releaseClient(client)
+	defer client.close()
+
+	ctx := context.Background()
+	first, err := client.acquire(ctx)
+	require.NoError(err)
+
+	// first connection is full
+	second, err := client.acquire(ctx)
+	require.NoError(err)
+	assert.NotSame(first, second)
+	assert.EqualValues(2, handshakes.Load())
+
+	// all connections are full
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.acquire(timeoutCtx)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+
+	time.AfterFunc(50*time.Millisecond, func() { client.release(second) })
+	third, err := client.acquire(ctx)
+	require.NoError(err)
+	assert.Same(second, third)
+	assert.EqualValues(2, handshakes.Load())
+
+	// forwardings release their channel when closed
+	client.release(first)
+	conn, err := client.dial(ctx, "tcp", target.Addr().String())
+	require.NoError(err)
+	client.mtx.Lock()
+	assert.Equal(1, first.channels)
+	client.mtx.Unlock()
+
+	conn.Close()
+	conn.Close()
+	client.mtx.Lock()
+	assert.Equal(0, first.channels)
+	client.mtx.Unlock()
+}
+
+func TestConnectionPoolIdle(t *testing.T) {
+	t.Parallel()
+
+	var handshakes atomic.Int32
+	sshPort := startSSHServer(t, &ssh.ServerConfig{
+		NoClientAuth: true,
+		NoClientAuthCallback: func(ssh.ConnMetadata) (*ssh.Permissions, error) {
+			handshakes.Add(1)
+			return nil, nil
+		},
+	})
+
+	var upstreams []string
+	var dialed atomic.Int32
+	for range 3 {
+		upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				dialed.Add(1)
+			}
+		}
+		upstream.Start()
+		defer upstream.Close()
+		upstreams = append(upstreams, upstream.Listener.Addr().String())
+	}
+
+	// one request at a time, twice to each upstream, the idle HTTP
+	// connections are reused
+	get := func(proxy *Proxy) {
+		dialed.Store(0)
+		for range 2 {
+			for _, upstream := range upstreams {
+				r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:"+strconv.Itoa(int(sshPort))+"/"+upstream+"/", nil)
+				r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "2")
+				w := httptest.NewRecorder()
+				proxy.ServeHTTP(w, r)
+				assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	proxy := newTestProxy()
+	proxy.maxChannels = 2
+	defer proxy.close()
+	get(proxy)
+	assert.EqualValues(t, 6, dialed.Load()) // idle connections are closed to free channels
+
+	handshakes.Store(0)
+	proxy = newTestProxy()
+	proxy.maxConns = 2
+	defer proxy.close()
+	get(proxy)
+	assert.EqualValues(t, 3, dialed.Load())
+	assert.LessOrEqual(t, handshakes.Load(), int32(2))
+}
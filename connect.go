@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultViaSeparator separates the destination host from the jump host
+// in tunnel destinations like "db.example.com.via.bastion".
+const defaultViaSeparator = ".via."
+
+var errJumpHostMissing = errors.New("jump host missing")
+
+// routeConnect passes CONNECT requests to the proxy and all other requests
+// to next. http.ServeMux does not route CONNECT requests, which have no
+// path.
+func routeConnect(proxy *Proxy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			proxy.serveConnect(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveConnect tunnels the client connection of a CONNECT request to the
+// destination through SSH.
+func (proxy *Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	key, address, err := proxy.parseConnect(r)
+	if errors.Is(err, errJumpHostMissing) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="jump host"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	client := proxy.getClient(*key)
+	defer proxy.releaseClient(client)
+
+	backend, err := client.dial(r.Context(), "tcp", address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintln(w, err)
+		return
+	}
+	defer backend.Close()
+
+	defer proxy.trackTunnel()()
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	pipe(conn, brw.Reader, backend, 0, &metrics.tunnels)
+}
+
+// parseConnect returns the client key and the destination address of a
+// CONNECT request, see tunnelKey.
+func (proxy *Proxy) parseConnect(r *http.Request) (*clientKey, string, error) {
+	host, port, err := net.SplitHostPort(r.URL.Host)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid destination: %w", err)
+	}
+
+	username, password, ok := proxyBasicAuth(r)
+	key, host, err := proxy.tunnelKey(host, username)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if ok && proxy.passwordAuth {
+		key.password = password
+	}
+
+	return &key, net.JoinHostPort(host, port), nil
+}
+
+// jumpHostMissing returns errJumpHostMissing with a hint on how to select
+// the jump host.
+func (proxy *Proxy) jumpHostMissing() error {
+	if proxy.viaSeparator == "" {
+		return fmt.Errorf("%w, use the proxy username", errJumpHostMissing)
+	}
+	return fmt.Errorf("%w, use the proxy username or <host>%s<jump host>", errJumpHostMissing, proxy.viaSeparator)
+}
+
+// tunnelKey returns the client key and the destination host of a tunnel
+// to the given host. The jump host is either appended to the destination
+// host with the via separator, or given as username in the form
+// "[user@]host", optionally preceded by comma-separated jump hosts.
+func (proxy *Proxy) tunnelKey(host, username string) (clientKey, string, error) {
+	var key clientKey
+	if dest, jump, found := proxy.cutVia(host); found {
+		if jump == "" {
+			return clientKey{}, "", proxy.jumpHostMissing()
+		}
+		key = clientKey{host: jump, port: defaultPort, username: username}
+		host = dest
+	} else if username != "" {
+		var err error
+		if key, err = parseHopChain(username); err != nil {
+			return clientKey{}, "", fmt.Errorf("invalid jump host: %w", err)
+		}
+	} else {
+		return clientKey{}, "", proxy.jumpHostMissing()
+	}
+
+	if host == "" {
+		return clientKey{}, "", errors.New("destination host missing")
+	}
+	return key, host, nil
+}
+
+// cutVia splits a host at the via separator, if any.
+func (proxy *Proxy) cutVia(host string) (string, string, bool) {
+	if proxy.viaSeparator == "" {
+		return host, "", false
+	}
+	return strings.Cut(host, proxy.viaSeparator)
+}
+
+// proxyBasicAuth returns the credentials of the Proxy-Authorization
+// header.
+func proxyBasicAuth(r *http.Request) (string, string, bool) {
+	auth := http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}
+	return auth.BasicAuth()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseConnect(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		target   string
+		username string
+		password string
+		key      clientKey
+		address  string
+		err      string
+	}{
+		{
+			target:  "db.example.com.via.bastion:5432",
+			key:     clientKey{host: "bastion", port: 22},
+			address: "db.example.com:5432",
+		},
+		{
+			target:   "db.example.com.via.bastion:5432",
+			username: "prometheus",
+			password: "secret",
+			key:      clientKey{host: "bastion", port: 22, username: "prometheus", password: "secret"},
+			address:  "db.example.com:5432",
+		},
+		{
+			target:   "10.0.0.1:22",
+			username: "outer,admin@bastion",
+			key:      clientKey{host: "bastion", port: 22, username: "admin", jump: "outer:22"},
+			address:  "10.0.0.1:22",
+		},
+		{
+			target:   "[fe80::1]:9100",
+			username: "bastion",
+			key:      clientKey{host: "bastion", port: 22},
+			address:  "[fe80::1]:9100",
+		},
+		{
+			target: "db.example.com:5432",
+			err:    "jump host missing, use the proxy username or <host>.via.<jump host>",
+		},
+		{
+			target: "db.example.com.via.:5432",
+			err:    "jump host missing, use the proxy username or <host>.via.<jump host>",
+		},
+		{
+			target: ".via.bastion:5432",
+			err:    "destination host missing",
+		},
+		{
+			target:   "db.example.com",
+			username: "bastion",
+			err:      "invalid destination: address db.example.com: missing port in address",
+		},
+		{
+			target:   "db.example.com:5432",
+			username: "bastion,",
+			err:      `invalid jump host: parsing "": host missing`,
+		},
+	}
+
+	proxy := NewProxy()
+	proxy.passwordAuth = true
+
+	for _, test := range tests {
+		t.Run(test.target, func(t *testing.T) {
+			assert := assert.New(t)
+
+			r := httptest.NewRequest(http.MethodConnect, test.target, nil)
+			if test.username != "" {
+				r.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(test.username+":"+test.password)))
+			}
+
+			key, address, err := proxy.parseConnect(r)
+			if test.err != "" {
+				assert.EqualError(err, test.err)
+				return
+			}
+			if assert.NoError(err) {
+				assert.Equal(test.key, *key)
+				assert.Equal(test.address, address)
+			}
+		})
+	}
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	proxy := newJumpHostProxy(t)
+	defer proxy.close()
+	proxyServer := httptest.NewServer(routeConnect(proxy, http.NotFoundHandler()))
+	defer proxyServer.Close()
+
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World")
+	}))
+	defer upstream.Close()
+
+	connect := func(target, username string) (*http.Response, error) {
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		if username != "" {
+			proxyURL.User = url.User(username)
+		}
+		client := upstream.Client()
+		transport := client.Transport.(*http.Transport)
+		transport.Proxy = http.ProxyURL(proxyURL)
+		transport.TLSClientConfig.ServerName = "example.com" // not the via host name
+		client.Timeout = 5 * time.Second
+		return client.Get("https://" + target + "/")
+	}
+
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+	for _, test := range []struct{ target, username string }{
+		{target: fmt.Sprintf("127.0.0.1:%d", port), username: "jump"},
+		{target: fmt.Sprintf("127.0.0.1.via.jump:%d", port)},
+	} {
+		res, err := connect(test.target, test.username)
+		if !assert.NoError(err, test.target) {
+			continue
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		assert.NoError(err)
+		assert.Equal("Hello World", string(body))
+	}
+
+	// data sent along with the request
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT 127.0.0.1:%d HTTP/1.1\r\nHost: proxy\r\nProxy-Authorization: Basic %s\r\n\r\nGET / HTTP/1.0\r\n\r\n",
+		port, base64.StdEncoding.EncodeToString([]byte("jump:")))
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	require.NoError(err)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	line, err := r.ReadString('\n')
+	assert.NoError(err)
+	assert.Contains(line, "HTTP/1.0 400 Bad Request") // plain HTTP to a TLS server
+
+	// jump host missing
+	_, err = connect(fmt.Sprintf("127.0.0.1:%d", port), "")
+	assert.ErrorContains(err, "Proxy Authentication Required")
+}
+
+func TestConnectShutdown(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+
+	newProxy := func() *Proxy { return newJumpHostProxy(t) }
+	testTunnelShutdown(t, newProxy, func(proxy *Proxy, server *httptest.Server) net.Conn {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(err)
+
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: proxy\r\nProxy-Authorization: Basic %s\r\n\r\n",
+			upstream.Listener.Addr(), base64.StdEncoding.EncodeToString([]byte("jump:")))
+		res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+		return conn
+	})
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key policies, modelled on OpenSSH's StrictHostKeyChecking.
+const (
+	// only hosts listed in known_hosts are accepted
+	hostKeyPolicyStrict = "yes"
+	// unknown hosts are accepted and appended to known_hosts
+	hostKeyPolicyAcceptNew = "accept-new"
+	// only hosts with pinned fingerprints are accepted
+	hostKeyPolicyPinned = "pinned"
+	// only hosts with pinned fingerprints or certificates of a trusted
+	// host CA are accepted
+	hostKeyPolicyCertAuthority = "cert-authority"
+)
+
+// hostKeyVerifier verifies host keys according to a policy. Revoked keys
+// are always rejected, pinned fingerprints take precedence over host
+// certificates, which take precedence over known_hosts.
+type hostKeyVerifier struct {
+	policy      string
+	knownHosts  string              // path to the known_hosts file
+	pins        map[string][]string // normalized host => SHA256 fingerprints
+	authorities []hostCA            // trusted host CAs
+	revoked     *revocationList
+	callback    ssh.HostKeyCallback // from known_hosts
+	mtx         sync.Mutex
+}
+
+// hostCA is a trusted host certificate authority.
+type hostCA struct {
+	key      ssh.PublicKey
+	patterns []string // host patterns, nil for any host
+}
+
+// newHostKeyVerifier reads the known_hosts file (unless the policy is
+// "pinned" or "cert-authority") and parses the pinned fingerprints, given as
+// "host[:port]=SHA256:...".
+func newHostKeyVerifier(policy, knownHosts string, pins []string) (*hostKeyVerifier, error) {
+	v := &hostKeyVerifier{
+		policy:     policy,
+		knownHosts: knownHosts,
+		pins:       make(map[string][]string),
+	}
+
+	for _, pin := range pins {
+		host, fingerprint, found := strings.Cut(pin, "=")
+		if !found || host == "" || !strings.HasPrefix(fingerprint, "SHA256:") {
+			return nil, fmt.Errorf("invalid host key pin %q, expected host=SHA256:...", pin)
+		}
+		host = knownhosts.Normalize(host)
+		v.pins[host] = append(v.pins[host], fingerprint)
+	}
+
+	switch policy {
+	case hostKeyPolicyStrict:
+	case hostKeyPolicyAcceptNew:
+		// create an empty file to learn keys into
+		f, err := os.OpenFile(knownHosts, os.O_CREATE|os.O_RDONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+	case hostKeyPolicyPinned, hostKeyPolicyCertAuthority:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unknown host key policy %q", policy)
+	}
+
+	var err error
+	v.callback, err = knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// check implements ssh.HostKeyCallback.
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	decision, err := v.decide(hostname, remote, key)
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if err != nil {
+		metrics.hostKeys.rejected++
+		log.Printf("host key %s %s of %s rejected: %v", key.Type(), fingerprint, hostname, err)
+		return err
+	}
+
+	switch decision {
+	case "learned":
+		metrics.hostKeys.learned++
+	case "pinned":
+		metrics.hostKeys.pinned++
+	case "certificate":
+		metrics.hostKeys.certified++
+	default:
+		metrics.hostKeys.accepted++
+	}
+	log.Printf("host key %s %s of %s accepted (%s)", key.Type(), fingerprint, hostname, decision)
+	return nil
+}
+
+// decide returns how the key was accepted, or why it was rejected.
+func (v *hostKeyVerifier) decide(hostname string, remote net.Addr, key ssh.PublicKey) (string, error) {
+	if v.revoked.isRevoked(key) {
+		return "", errors.New("host key is revoked")
+	}
+
+	if pins, ok := v.pins[knownhosts.Normalize(hostname)]; ok {
+		plain := key
+		if cert, ok := key.(*ssh.Certificate); ok {
+			plain = cert.Key
+		}
+		if slices.Contains(pins, ssh.FingerprintSHA256(plain)) {
+			return "pinned", nil
+		}
+		return "", errors.New("fingerprint does not match any pin")
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok && v.isAuthority(cert.SignatureKey, hostname) {
+		// checks principals, validity period and signature
+		checker := ssh.CertChecker{IsHostAuthority: v.isAuthority}
+		if err := checker.CheckHostKey(hostname, remote, key); err != nil {
+			return "", err
+		}
+		return "certificate", nil
+	}
+
+	switch v.policy {
+	case hostKeyPolicyPinned:
+		return "", errors.New("no fingerprint pinned")
+	case hostKeyPolicyCertAuthority:
+		return "", errors.New("no certificate of a trusted host CA")
+	}
+
+	err := v.callback(hostname, remote, key)
+	if err == nil {
+		return "known_hosts", nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if v.policy != hostKeyPolicyAcceptNew || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+		return "", err
+	}
+
+	// unknown host, learn its key
+	if err := v.learn(hostname, key); err != nil {
+		return "", fmt.Errorf("unable to add key to %s: %w", v.knownHosts, err)
+	}
+	return "learned", nil
+}
+
+// isAuthority checks whether the key is a host CA trusted for the address.
+func (v *hostKeyVerifier) isAuthority(key ssh.PublicKey, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(host)
+
+	blob := key.Marshal()
+	for _, ca := range v.authorities {
+		if !bytes.Equal(ca.key.Marshal(), blob) {
+			continue
+		}
+		if ca.patterns == nil || (&sshConfigBlock{patterns: ca.patterns}).matches(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHostCAs reads trusted host CA keys, one per line. As in known_hosts,
+// a line may be prefixed with "@cert-authority" and comma-separated host
+// patterns to restrict the hosts a CA is trusted for.
+func readHostCAs(file string) ([]hostCA, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var authorities []hostCA
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		var ca hostCA
+		if fields := strings.Fields(line); fields[0] == "@cert-authority" {
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%s:%d: host patterns or key missing", file, lineNo)
+			}
+			ca.patterns = strings.Split(fields[1], ",")
+			line = strings.Join(fields[2:], " ")
+		}
+
+		ca.key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+		}
+		authorities = append(authorities, ca)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("%s: no host CA keys found", file)
+	}
+	return authorities, nil
+}
+
+// learn appends the key to the known_hosts file and reloads it.
+func (v *hostKeyVerifier) learn(hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(v.knownHosts, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	callback, err := knownhosts.New(v.knownHosts)
+	if err != nil {
+		return err
+	}
+	v.callback = callback
+	return nil
+}
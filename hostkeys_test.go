@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return key
+}
+
+func TestHostKeyVerifier(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	known := newTestHostKey(t)
+	other := newTestHostKey(t)
+
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(os.WriteFile(knownHosts, []byte(knownhosts.Line([]string{"known:22"}, known)+"\n"), 0o600))
+
+	pins := []string{
+		"pinned.example.com=" + ssh.FingerprintSHA256(other),
+		"known:2222=" + ssh.FingerprintSHA256(other),
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		v, err := newHostKeyVerifier(hostKeyPolicyStrict, knownHosts, pins)
+		require.NoError(err)
+
+		assert.NoError(v.check("known:22", remote, known))
+		assert.Error(v.check("known:22", remote, other))
+		assert.Error(v.check("unknown:22", remote, known))
+
+		// pins take precedence
+		assert.NoError(v.check("pinned.example.com:22", remote, other))
+		assert.NoError(v.check("known:2222", remote, other))
+		assert.EqualError(v.check("pinned.example.com:22", remote, known), "fingerprint does not match any pin")
+	})
+
+	t.Run("pinned", func(t *testing.T) {
+		v, err := newHostKeyVerifier(hostKeyPolicyPinned, "does-not-exist", pins)
+		require.NoError(err)
+
+		assert.NoError(v.check("pinned.example.com:22", remote, other))
+		assert.EqualError(v.check("known:22", remote, known), "no fingerprint pinned")
+	})
+
+	t.Run("accept-new", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "known_hosts")
+		v, err := newHostKeyVerifier(hostKeyPolicyAcceptNew, file, nil)
+		require.NoError(err)
+
+		learned := metrics.hostKeys.learned
+		assert.NoError(v.check("new.example.com:2222", remote, known))
+		assert.Equal(learned+1, metrics.hostKeys.learned)
+
+		// learned key is known now
+		accepted := metrics.hostKeys.accepted
+		assert.NoError(v.check("new.example.com:2222", remote, known))
+		assert.Equal(accepted+1, metrics.hostKeys.accepted)
+
+		// changed keys are still rejected
+		assert.Error(v.check("new.example.com:2222", remote, other))
+
+		content, err := os.ReadFile(file)
+		require.NoError(err)
+		assert.Equal(knownhosts.Line([]string{"[new.example.com]:2222"}, known)+"\n", string(content))
+	})
+}
+
+// signHostCert creates a host certificate for the key, signed by the CA
+// from the fixtures.
+func signHostCert(t *testing.T, key ssh.PublicKey, serial uint64, principals ...string) *ssh.Certificate {
+	t.Helper()
+
+	buf, err := os.ReadFile("fixtures/hostkeys/host_ca")
+	require.NoError(t, err)
+	ca, err := ssh.ParsePrivateKey(buf)
+	require.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          serial,
+		CertType:        ssh.HostCert,
+		ValidPrincipals: principals,
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestHostKeyVerifierCertificates(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	remote := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+	key := newTestHostKey(t)
+	ca := readPublicKey(t, "fixtures/hostkeys/host_ca.pub")
+
+	caFile := filepath.Join(t.TempDir(), "host_ca")
+	require.NoError(os.WriteFile(caFile, []byte("# fleet\n@cert-authority *.example.com,!*.internal.example.com "+string(ssh.MarshalAuthorizedKey(ca))), 0o600))
+
+	authorities, err := readHostCAs(caFile)
+	require.NoError(err)
+	require.Len(authorities, 1)
+
+	v, err := newHostKeyVerifier(hostKeyPolicyCertAuthority, "does-not-exist", nil)
+	require.NoError(err)
+	v.authorities = authorities
+	v.revoked, err = readRevocationList("fixtures/hostkeys/revoked_host_keys.krl")
+	require.NoError(err)
+
+	certified := metrics.hostKeys.certified
+	assert.NoError(v.check("a.example.com:22", remote, signHostCert(t, key, 1, "a.example.com")))
+	assert.Equal(certified+1, metrics.hostKeys.certified)
+
+	// principal must match the dialed host
+	assert.ErrorContains(v.check("b.example.com:22", remote, signHostCert(t, key, 1, "a.example.com")), "principal")
+
+	// CA not trusted for the host
+	assert.EqualError(v.check("a.internal.example.com:22", remote, signHostCert(t, key, 1, "a.internal.example.com")), "no certificate of a trusted host CA")
+
+	// revoked serial
+	assert.EqualError(v.check("a.example.com:22", remote, signHostCert(t, key, 5, "a.example.com")), "host key is revoked")
+
+	// plain keys
+	assert.EqualError(v.check("a.example.com:22", remote, key), "no certificate of a trusted host CA")
+	assert.EqualError(v.check("a.example.com:22", remote, readPublicKey(t, "fixtures/hostkeys/host_key_revoked.pub")), "host key is revoked")
+}
+
+func TestReadHostCAs(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	ca := readPublicKey(t, "fixtures/hostkeys/host_ca.pub")
+	keyType, keyData, _ := strings.Cut(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca))), " ")
+
+	// fields separated by tabs and several spaces
+	file := filepath.Join(t.TempDir(), "host_ca")
+	require.NoError(os.WriteFile(file, []byte("@cert-authority\t*.example.com\t"+keyType+"  "+keyData+" fleet CA\n"), 0o600))
+	authorities, err := readHostCAs(file)
+	require.NoError(err)
+	require.Len(authorities, 1)
+	assert.Equal([]string{"*.example.com"}, authorities[0].patterns)
+	assert.Equal(ca.Marshal(), authorities[0].key.Marshal())
+
+	require.NoError(os.WriteFile(file, []byte("@cert-authority *.example.com\n"), 0o600))
+	_, err = readHostCAs(file)
+	assert.EqualError(err, file+":1: host patterns or key missing")
+}
+
+func TestHostKeyVerifierErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := newHostKeyVerifier("ask", "known_hosts", nil)
+	assert.EqualError(t, err, `unknown host key policy "ask"`)
+
+	_, err = newHostKeyVerifier(hostKeyPolicyStrict, "known_hosts", []string{"example.com=MD5:00"})
+	assert.EqualError(t, err, `invalid host key pin "example.com=MD5:00", expected host=SHA256:...`)
+
+	_, err = newHostKeyVerifier(hostKeyPolicyStrict, "does-not-exist", nil)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = readHostCAs("fixtures/hostkeys/host_key_hashed.pub")
+	assert.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "host_ca")
+	require.NoError(t, os.WriteFile(file, []byte("# empty\n"), 0o600))
+	_, err = readHostCAs(file)
+	assert.ErrorContains(t, err, "no host CA keys found")
+}
@@ -2,18 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const defaultPort = 22
 
+// requestContextKey is the context key for the context of the proxied
+// request, see cancelWithRequest.
+type requestContextKey struct{}
+
 func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
@@ -24,29 +31,154 @@ func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// abort SSH handshakes and forwardings once Prometheus gives up
+	ctx := r.Context()
+	if timeout, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64); err == nil && timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout*float64(time.Second)))
+		defer cancel()
+	}
+	r = r.WithContext(context.WithValue(ctx, requestContextKey{}, ctx))
+
+	// the password must be part of the key, connections authenticated
+	// with different passwords must not be shared
+	if _, password, ok := r.BasicAuth(); ok && proxy.passwordAuth {
+		key.password = password
+		// not meant for the destination
+		r.Header.Del("Authorization")
+	}
+
 	r.Close = false
 	r.Host = ""
 	r.URL, _ = url.Parse(uri)
 	r.RequestURI = ""
+	upgrade := upgradeType(r.Header)
 	removeHopHeaders(r.Header)
+	if upgrade != "" {
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", upgrade)
+	}
+
+	if _, ok := unixSocketPath(r.URL.Host); ok {
+		// don't leak the encoded socket path
+		r.Host = "localhost"
+	}
+
+	client := proxy.getClient(*key)
+	defer proxy.releaseClient(client)
 
 	// do the request
-	res, err := proxy.getClient(*key).httpClient.Do(r)
+	res, retries, err := proxy.do(client, r)
+	if retries > 0 {
+		w.Header().Set("X-Proxy-Retries", strconv.Itoa(retries))
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadGateway)
 		fmt.Fprintln(w, err.Error())
 		return
 	}
 
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		proxy.serveUpgrade(w, res, upgrade)
+		return
+	}
+
 	// copy response header and body
 	copyHeader(w.Header(), res.Header)
+	announced := len(res.Trailer)
+	announceTrailers(w.Header(), res.Trailer)
 	w.WriteHeader(res.StatusCode)
-	_, _ = io.Copy(w, res.Body)
+
+	// the body is read until the client goes away, which cancels the
+	// request and with it the forwarding
+	err = copyBody(w, res.Body, isStreaming(res))
 	res.Body.Close()
+	if err != nil {
+		return
+	}
+
+	copyTrailers(w.Header(), res.Trailer, announced)
+}
+
+// isStreaming checks whether the response is produced gradually, like
+// server-sent events or chunked responses of unknown length.
+func isStreaming(res *http.Response) bool {
+	if res.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// copyBody copies the response body to the client. If flush is set, data
+// is flushed as soon as it arrives.
+func copyBody(w http.ResponseWriter, body io.Reader, flush bool) error {
+	if !flush {
+		_, err := io.Copy(w, body)
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// announceTrailers declares the trailers of the response, so that they
+// can be sent after the body.
+func announceTrailers(dst, trailer http.Header) {
+	if len(trailer) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(trailer))
+	for k := range trailer {
+		keys = append(keys, k)
+	}
+	dst.Add("Trailer", strings.Join(keys, ", "))
+}
+
+// copyTrailers copies the trailers received after the body. If there are
+// trailers which were not announced, all trailers need to be prefixed.
+func copyTrailers(dst, trailer http.Header, announced int) {
+	if len(trailer) == announced {
+		copyHeader(dst, trailer)
+		return
+	}
+
+	for k, vv := range trailer {
+		for _, v := range vv {
+			dst.Add(http.TrailerPrefix+k, v)
+		}
+	}
 }
 
 func parseRequest(r *http.Request) (*clientKey, string, error) {
-	target, err := url.Parse(r.RequestURI)
+	requestURI, jump, err := splitJumpHosts(r.RequestURI)
+	if err != nil {
+		return nil, "", err
+	}
+
+	target, err := url.Parse(requestURI)
 	if err != nil {
 		return nil, "", fmt.Errorf("unable to parse URI: %w", err)
 	}
@@ -61,17 +193,13 @@ func parseRequest(r *http.Request) (*clientKey, string, error) {
 
 	key := clientKey{
 		host: target.Hostname(),
+		jump: jump,
 	}
 
 	// Parse port
-	if port := target.Port(); port != "" {
-		ui, err := strconv.ParseUint(port, 10, 16)
-		if err != nil {
-			return nil, "", fmt.Errorf("parsing \"%v\": invalid port number", port)
-		}
-		key.port = uint16(ui)
-	} else {
-		key.port = defaultPort
+	key.port, err = parsePort(target.Port())
+	if err != nil {
+		return nil, "", err
 	}
 
 	// Parse username
@@ -84,9 +212,84 @@ func parseRequest(r *http.Request) (*clientKey, string, error) {
 		}
 	}
 
+	// Parse Unix domain socket destination
+	if rest, ok := strings.CutPrefix(target.RequestURI(), "/unix:"); ok {
+		socket, path, err := parseUnixDestination(rest)
+		if err != nil {
+			return nil, "", err
+		}
+		return &key, target.Scheme + "://" + unixSocketHost(socket) + path, nil
+	}
+
 	return &key, target.Scheme + ":/" + target.RequestURI(), nil
 }
 
+// splitJumpHosts removes all but the last SSH hop from the authority of
+// the request URI. The removed hops are returned in their canonical form.
+func splitJumpHosts(requestURI string) (string, string, error) {
+	scheme, rest, found := strings.Cut(requestURI, "://")
+	if !found {
+		return requestURI, "", nil
+	}
+
+	authority := rest
+	if i := strings.IndexByte(rest, '/'); i != -1 {
+		authority = rest[:i]
+	}
+
+	i := strings.LastIndexByte(authority, ',')
+	if i == -1 {
+		return requestURI, "", nil
+	}
+
+	jump, err := parseJumpHosts(strings.Split(authority[:i], ","))
+	if err != nil {
+		return "", "", err
+	}
+
+	return scheme + "://" + rest[i+1:], jump, nil
+}
+
+// parseJumpHosts returns the canonical form of the given hops.
+func parseJumpHosts(hops []string) (string, error) {
+	var jump string
+	for _, hop := range hops {
+		key, err := parseHop(hop)
+		if err != nil {
+			return "", fmt.Errorf("invalid jump host: %w", err)
+		}
+		key.jump = jump
+		jump = key.String()
+	}
+	return jump, nil
+}
+
+// parseUnixDestination splits "<socket-path>:<path>" into the socket path
+// and the request path. The request path may be omitted.
+func parseUnixDestination(dest string) (string, string, error) {
+	socket, path, found := strings.Cut(dest, ":")
+	if !found {
+		// no request path, but maybe a query
+		if i := strings.IndexByte(socket, '?'); i != -1 {
+			socket, path = socket[:i], socket[i:]
+		}
+	}
+
+	socket, err := url.PathUnescape(socket)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to parse socket path: %w", err)
+	}
+	if socket == "" {
+		return "", "", errors.New("socket path missing in request URI")
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return socket, path, nil
+}
+
 // Hop-by-hop headers. These are removed when sent to the backend.
 // http://www.w3.org/Protocols/rfc2616/rfc2616-sec13.html
 var hopHeaders = []string{
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -25,6 +32,12 @@ type directTCPPayload struct {
 	OriginPort uint32
 }
 
+type directStreamLocalPayload struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
 var (
 	httpServer  *http.Server
 	lastRequest *http.Request // the last received request
@@ -55,9 +68,9 @@ func TestHTTP(t *testing.T) {
 		},
 	}
 
-	private, err := getKeyFile("fixtures/id_ed25519")
+	private, err := loadIdentity("fixtures/id_ed25519")
 	require.NoError(err)
-	config.AddHostKey(private)
+	config.AddHostKey(private.signer)
 
 	sshListener, err := net.Listen("tcp", sshPort)
 	require.NoError(err)
@@ -71,21 +84,29 @@ func TestHTTP(t *testing.T) {
 	require.NoError(err)
 	defer proxyListener.Close()
 
-	authMethods := readPrivateKeys("fixtures/id_ed25519")
+	socketPath := filepath.Join(t.TempDir(), "http.sock")
+	unixListener, err := net.Listen("unix", socketPath)
+	require.NoError(err)
+	defer unixListener.Close()
 
 	proxy = NewProxy()
-	proxy.sshConfig = ssh.ClientConfig{
-		Timeout: time.Second,
-		User:    "prometheus",
-		Auth:    authMethods,
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// always successful
-			return nil
+	proxy.sshConfig.Store(&sshSettings{
+		config: ssh.ClientConfig{
+			Timeout: time.Second,
+			User:    "prometheus",
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				// always successful
+				return nil
+			},
 		},
-	}
+		keys: newKeyring("fixtures/id_ed25519"),
+	})
 
 	go serveSSH(sshListener, config)
 	go serveHTTP(httpListener)
+	go http.Serve(unixListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello %s from %s", r.Host, r.URL.Path)
+	}))
 	go serveProxy(proxyListener, proxy)
 
 	proxyURL, _ := url.Parse(fmt.Sprintf("http://%s/", proxyPort))
@@ -162,9 +183,7 @@ func TestHTTP(t *testing.T) {
 		// So we need to do more work
 		httpServer.Close()
 		for _, client := range proxy.clients {
-			if client := client.sshClient; client != nil {
-				client.Close()
-			}
+			client.close()
 		}
 
 		response, err := client.Get(fmt.Sprintf("http://%s/%s/test", sshPort, httpPort))
@@ -176,6 +195,249 @@ func TestHTTP(t *testing.T) {
 		assert.EqualValues(2, metrics.forwardings.failed)
 		response.Body.Close()
 	}
+
+	// valid request to Unix socket via valid jumphost
+	{
+		response, err := client.Get(fmt.Sprintf("http://%s/unix:%s:/test", sshPort, socketPath))
+		assert.NoError(err)
+		if response != nil {
+			assert.EqualValues(2, metrics.connections.established)
+			assert.EqualValues(2, metrics.forwardings.established)
+			assert.Equal(200, response.StatusCode)
+
+			bytes, _ := io.ReadAll(response.Body)
+			assert.Equal("Hello localhost from /test", string(bytes))
+			response.Body.Close()
+		}
+	}
+
+	// valid request via chained jumphosts
+	{
+		response, err := client.Get(fmt.Sprintf("http://%s,%s/unix:%s:/test", sshPort, sshPort, socketPath))
+		assert.NoError(err)
+		if response != nil {
+			assert.Equal(200, response.StatusCode)
+			response.Body.Close()
+		}
+
+		proxy.mtx.Lock()
+		assert.Contains(proxy.clients, clientKey{host: "127.0.0.1", port: 10022, jump: "127.0.0.1:10022"})
+		assert.True(proxy.clients[clientKey{host: "127.0.0.1", port: 10022, jump: "127.0.0.1:10022"}].isConnected())
+		proxy.mtx.Unlock()
+	}
+
+	// HTTPS requests via valid jumphost
+	{
+		tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello TLS")
+		}))
+		defer tlsServer.Close()
+
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		require.NoError(os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: tlsServer.Certificate().Raw,
+		}), 0o600))
+
+		uri := fmt.Sprintf("https://%s/%s/test", sshPort, tlsServer.Listener.Addr())
+
+		// unknown certificate authority
+		clear(proxy.clients)
+		response, err := proxyRequest(proxyPort, uri)
+		require.NoError(err)
+		assert.Equal(http.StatusBadGateway, response.StatusCode)
+		assert.Contains(response.Body, "certificate signed by unknown authority")
+
+		// trusted certificate authority
+		clear(proxy.clients)
+		proxy.tlsConfigs = tlsConfigs{{pattern: "127.0.0.1", config: &tls.Config{RootCAs: tlsServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}}}
+		response, err = proxyRequest(proxyPort, uri)
+		require.NoError(err)
+		assert.Equal(http.StatusOK, response.StatusCode)
+		assert.Equal("Hello TLS", response.Body)
+
+		// loaded from settings
+		clear(proxy.clients)
+		settings := tlsSettings{Host: "*", CA: caFile}
+		config, err := settings.build()
+		require.NoError(err)
+		proxy.tlsConfigs = tlsConfigs{{pattern: settings.Host, config: config}}
+		response, err = proxyRequest(proxyPort, uri)
+		require.NoError(err)
+		assert.Equal(http.StatusOK, response.StatusCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	sshPort := startSSHServer(t, config)
+
+	run := func(timeout time.Duration) (*client, error) {
+		proxy := newTestProxy()
+
+		client := proxy.getClient(clientKey{host: "127.0.0.1", port: sshPort})
+		proxy.releaseClient(client)
+		_, err := client.acquire(context.Background())
+		require.NoError(err)
+
+		// a running request, which takes 200ms
+		started := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "done")
+		}))
+		go func() {
+			if res, err := http.Get(server.URL); err == nil {
+				res.Body.Close()
+			}
+		}()
+		<-started
+
+		err = shutdown(server.Config, proxy, timeout)
+		assert.Empty(proxy.clients)
+		return client, err
+	}
+
+	client, err := run(time.Second)
+	assert.NoError(err)
+	assert.False(client.isConnected())
+
+	client, err = run(50 * time.Millisecond)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.False(client.isConnected())
+}
+
+// testTunnelShutdown checks that shutdown waits for a tunnel opened by
+// open through a proxy returned by newProxy, and closes it after the
+// timeout.
+func testTunnelShutdown(t *testing.T, newProxy func() *Proxy, open func(proxy *Proxy, server *httptest.Server) net.Conn) {
+	assert := assert.New(t)
+
+	run := func() (*Proxy, *httptest.Server, net.Conn) {
+		proxy := newProxy()
+		server := httptest.NewServer(routeConnect(proxy, proxy))
+		conn := open(proxy, server)
+		t.Cleanup(func() { conn.Close() })
+		return proxy, server, conn
+	}
+
+	// closed by the client during the grace period
+	proxy, server, conn := run()
+	done := make(chan error, 1)
+	go func() {
+		done <- shutdown(server.Config, proxy, 5*time.Second)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown did not wait for the tunnel: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+	assert.NoError(<-done)
+
+	// still open after the grace period
+	proxy, server, conn = run()
+	err := shutdown(server.Config, proxy, 100*time.Millisecond)
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	assert.NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(err, io.EOF)
+}
+
+func TestStreaming(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	sshPort := startSSHServer(t, config)
+
+	gone := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: hello\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(gone)
+	})
+	mux.HandleFunc("/trailers", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		fmt.Fprint(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	})
+	upstream := httptest.NewServer(mux)
+	defer upstream.Close()
+
+	proxy := newTestProxy()
+	defer proxy.close()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+	base := fmt.Sprintf("http://127.0.0.1:%d/%s", sshPort, upstream.Listener.Addr())
+
+	// events arrive before the response ends
+	res, err := client.Get(base + "/events")
+	require.NoError(err)
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	assert.NoError(err)
+	assert.Equal("data: hello\n", line)
+
+	// the upstream request is canceled with the client request
+	res.Body.Close()
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		assert.Fail("upstream request not canceled")
+	}
+
+	res, err = client.Get(base + "/trailers")
+	require.NoError(err)
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(err)
+	assert.Equal("body", string(body))
+	assert.Equal("abc", res.Trailer.Get("X-Checksum"))
+	assert.Equal("late", res.Trailer.Get("X-Late"))
+}
+
+type rawResponse struct {
+	StatusCode int
+	Body       string
+}
+
+// proxyRequest sends a GET request with the given absolute URI to the
+// proxy. Unlike http.Client, it does not use CONNECT for HTTPS URIs.
+func proxyRequest(proxyAddr, uri string) (*rawResponse, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n", uri)
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	return &rawResponse{StatusCode: response.StatusCode, Body: string(body)}, err
 }
 
 func serveHTTP(listener net.Listener) {
@@ -201,6 +463,57 @@ func serveProxy(listener net.Listener, proxy *Proxy) {
 	server.Serve(listener)
 }
 
+// listenSSH adds the test host key to the config and returns a listener
+// for an SSH server, which is closed with the test.
+func listenSSH(t *testing.T, config *ssh.ServerConfig) net.Listener {
+	t.Helper()
+
+	hostKey, err := loadIdentity("fixtures/id_ed25519")
+	require.NoError(t, err)
+	config.AddHostKey(hostKey.signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// startSSHServer starts an SSH server on 127.0.0.1 and returns its port.
+func startSSHServer(t *testing.T, config *ssh.ServerConfig) uint16 {
+	t.Helper()
+
+	listener := listenSSH(t, config)
+	go serveSSH(listener, config)
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// newTestProxy returns a proxy accepting any host key.
+func newTestProxy() *Proxy {
+	proxy := NewProxy()
+	proxy.sshConfig.Store(&sshSettings{config: ssh.ClientConfig{
+		Timeout:         time.Second,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}})
+	return proxy
+}
+
+// newJumpHostProxy starts an SSH server and returns a proxy, which knows
+// it as host "jump" from its OpenSSH client configuration.
+func newJumpHostProxy(t *testing.T) *Proxy {
+	t.Helper()
+
+	sshPort := startSSHServer(t, &ssh.ServerConfig{NoClientAuth: true})
+	file := writeSSHConfig(t, map[string]string{
+		"config": fmt.Sprintf("Host jump\n  HostName 127.0.0.1\n  Port %d\n", sshPort),
+	})
+	hosts, err := readSSHConfig(file)
+	require.NoError(t, err)
+
+	proxy := newTestProxy()
+	proxy.hosts = hosts
+	return proxy
+}
+
 func serveSSH(listener net.Listener, config *ssh.ServerConfig) {
 	for {
 		tcpConn, err := listener.Accept()
@@ -213,7 +526,8 @@ func serveSSH(listener net.Listener, config *ssh.ServerConfig) {
 		sshConn, chans, reqs, err := ssh.NewServerConn(tcpConn, config)
 		if err != nil {
 			log.Printf("Failed to handshake (%s)", err)
-			return
+			tcpConn.Close()
+			continue
 		}
 
 		log.Printf("New SSH connection from %s (%s)", sshConn.RemoteAddr(), sshConn.ClientVersion())
@@ -232,10 +546,39 @@ func handleChannels(chans <-chan ssh.NewChannel) {
 }
 
 func handleChannel(newChannel ssh.NewChannel) {
-	if t := newChannel.ChannelType(); t != "direct-tcpip" {
+	switch t := newChannel.ChannelType(); t {
+	case "direct-tcpip":
+		handleDirectTCP(newChannel)
+	case "direct-streamlocal@openssh.com":
+		handleDirectStreamLocal(newChannel)
+	default:
 		panic(fmt.Sprintf("unknown channel type: %s", t))
 	}
+}
+
+func handleDirectStreamLocal(newChannel ssh.NewChannel) {
+	var payload directStreamLocalPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		panic(err)
+	}
+
+	rconn, err := net.Dial("unix", payload.SocketPath)
+	if err != nil {
+		log.Println("Could not dial remote:", err)
+		newChannel.Reject(ssh.Prohibited, err.Error())
+		return
+	}
+
+	connection, requests, err := newChannel.Accept()
+	if err != nil {
+		panic(err)
+	}
+	go ssh.DiscardRequests(requests)
+
+	serve(connection, rconn)
+}
 
+func handleDirectTCP(newChannel ssh.NewChannel) {
 	var payload directTCPPayload
 	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
 		panic(err)
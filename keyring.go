@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// identity is a private key along with its optional OpenSSH user
+// certificate ("<path>-cert.pub"). The certificate is reloaded when its
+// file changes, so that renewed certificates are used without a restart.
+type identity struct {
+	path     string
+	key      ssh.Signer // without certificate
+	signer   ssh.Signer // with certificate, if any
+	cert     *ssh.Certificate
+	certTime time.Time // modification time of the certificate file
+}
+
+// loadIdentity reads a private key and its certificate. If the
+// certificate can't be loaded, the key is used without it.
+func loadIdentity(path string) (*identity, error) {
+	key, err := getPrivateKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &identity{
+		path:   path,
+		key:    key,
+		signer: key,
+	}
+	if err := id.loadCertificate(); err != nil {
+		log.Printf("unable to load certificate: %v", err)
+	}
+	return id, nil
+}
+
+func (id *identity) certPath() string {
+	return id.path + "-cert.pub"
+}
+
+// loadCertificate (re-)loads the certificate if its file has changed
+// since the last call. On errors, the previous certificate is kept.
+func (id *identity) loadCertificate() error {
+	var modTime time.Time
+	info, err := os.Stat(id.certPath())
+	if err == nil {
+		modTime = info.ModTime()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if modTime.Equal(id.certTime) {
+		return nil // unchanged
+	}
+	id.certTime = modTime
+
+	if modTime.IsZero() {
+		// certificate removed
+		id.cert = nil
+		id.signer = id.key
+		return nil
+	}
+
+	cert, err := getCertificate(id.certPath())
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.NewCertSigner(cert, id.key)
+	if err != nil {
+		return fmt.Errorf("%s: %w", id.certPath(), err)
+	}
+
+	id.cert = cert
+	id.signer = signer
+	log.Printf("loaded certificate %s, valid until %s", id.certPath(), certValidBefore(cert))
+	return nil
+}
+
+// certValidBefore returns the expiry of the certificate as a time.Time.
+func certValidBefore(cert *ssh.Certificate) time.Time {
+	if cert.ValidBefore > math.MaxInt64 {
+		return time.Time{}
+	}
+	return time.Unix(int64(cert.ValidBefore), 0)
+}
+
+// keyring holds a list of identities.
+type keyring struct {
+	identities []*identity
+	mtx        sync.Mutex
+}
+
+// newKeyring creates a keyring with the private keys from the given
+// files, skipping those which can't be loaded.
+func newKeyring(paths ...string) *keyring {
+	return &keyring{identities: readPrivateKeys(paths...)}
+}
+
+// Len returns the number of identities.
+func (k *keyring) Len() int {
+	if k == nil {
+		return 0
+	}
+	return len(k.identities)
+}
+
+// Signers returns the signers of all identities, with changed
+// certificates reloaded.
+func (k *keyring) Signers() []ssh.Signer {
+	if k == nil {
+		return nil
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	signers := make([]ssh.Signer, 0, len(k.identities))
+	for _, id := range k.identities {
+		if err := id.loadCertificate(); err != nil {
+			log.Printf("unable to reload certificate: %v", err)
+		}
+		signers = append(signers, id.signer)
+	}
+	return signers
+}
+
+// certificates returns the current certificates by key file.
+func (k *keyring) certificates() map[string]*ssh.Certificate {
+	certs := make(map[string]*ssh.Certificate)
+	if k == nil {
+		return certs
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+
+	for _, id := range k.identities {
+		if err := id.loadCertificate(); err != nil {
+			log.Printf("unable to reload certificate: %v", err)
+		}
+		if id.cert != nil {
+			certs[id.path] = id.cert
+		}
+	}
+	return certs
+}
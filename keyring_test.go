@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyringCertificateRenewal(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	buf, err := os.ReadFile("fixtures/id_ed25519")
+	require.NoError(err)
+	require.NoError(os.WriteFile(path, buf, 0o600))
+
+	keys := newKeyring(path)
+	require.Equal(1, keys.Len())
+	key := keys.Signers()[0].PublicKey()
+	assert.Empty(keys.certificates())
+
+	writeCert := func(cert *ssh.Certificate, modTime time.Time) {
+		require.NoError(os.WriteFile(path+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0o600))
+		require.NoError(os.Chtimes(path+"-cert.pub", modTime, modTime))
+	}
+
+	// certificate issued after startup
+	now := time.Now().Truncate(time.Second)
+	first := signUserCert(t, key, now.Add(8*time.Hour))
+	writeCert(first, now)
+	assert.Equal(first.Marshal(), keys.Signers()[0].PublicKey().Marshal())
+	if certs := keys.certificates(); assert.Contains(certs, path) {
+		assert.Equal(first.Marshal(), certs[path].Marshal())
+	}
+	assert.Equal(now.Add(8*time.Hour), certValidBefore(first))
+
+	// renewed certificate
+	second := signUserCert(t, key, now.Add(16*time.Hour))
+	writeCert(second, now.Add(time.Second))
+	assert.Equal(second.Marshal(), keys.Signers()[0].PublicKey().Marshal())
+
+	// broken certificate keeps the previous one
+	require.NoError(os.WriteFile(path+"-cert.pub", []byte("garbage"), 0o600))
+	require.NoError(os.Chtimes(path+"-cert.pub", now.Add(2*time.Second), now.Add(2*time.Second)))
+	assert.Equal(second.Marshal(), keys.Signers()[0].PublicKey().Marshal())
+
+	// removed certificate
+	require.NoError(os.Remove(path + "-cert.pub"))
+	assert.Equal(key.Marshal(), keys.Signers()[0].PublicKey().Marshal())
+	assert.Empty(keys.certificates())
+}
+
+func TestClientCertificates(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	buf, err := os.ReadFile("fixtures/id_ed25519")
+	require.NoError(err)
+	defaultKey := filepath.Join(dir, "id_default")
+	hostKey := filepath.Join(dir, "id_host")
+	for _, path := range []string{defaultKey, hostKey} {
+		require.NoError(os.WriteFile(path, buf, 0o600))
+	}
+
+	proxy := NewProxy()
+	proxy.sshConfig.Store(&sshSettings{keys: newKeyring(defaultKey)})
+	client := proxy.getClient(clientKey{host: "example.com", port: 22})
+	client.hostKeys = newKeyring(hostKey)
+	assert.Empty(proxy.clientCertificates())
+
+	key := client.hostKeys.Signers()[0].PublicKey()
+	for _, path := range []string{defaultKey, hostKey} {
+		cert := signUserCert(t, key, time.Now().Add(time.Hour))
+		require.NoError(os.WriteFile(path+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0o600))
+	}
+
+	certs := proxy.clientCertificates()
+	assert.Len(certs, 2)
+	assert.Contains(certs, defaultKey)
+	assert.Contains(certs, hostKey)
+}
+
+func TestNilKeyring(t *testing.T) {
+	t.Parallel()
+
+	var keys *keyring
+	assert.Equal(t, 0, keys.Len())
+	assert.Empty(t, keys.Signers())
+	assert.Empty(t, keys.certificates())
+}
+
+func TestCertValidBefore(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, certValidBefore(&ssh.Certificate{ValidBefore: ssh.CertTimeInfinity}).IsZero())
+	assert.Equal(t, time.Unix(1700000000, 0), certValidBefore(&ssh.Certificate{ValidBefore: 1700000000}))
+}
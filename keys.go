@@ -1,29 +1,169 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
 
-// Reads a SSH private key file.
-func getKeyFile(path string) (ssh.Signer, error) {
+var (
+	errPassphraseMissing = errors.New("key is encrypted, but no passphrase found")
+	errPassphraseWrong   = errors.New("wrong passphrase")
+)
+
+// Reads a SSH private key file. Encrypted keys are unlocked with the
+// passphrase returned by keyPassphrase.
+func getPrivateKey(path string) (ssh.Signer, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(buf)
+	var missingErr *ssh.PassphraseMissingError
+	if !errors.As(err, &missingErr) {
+		return signer, err
+	}
+
+	passphrase, err := keyPassphrase(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, passphrase)
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, errPassphraseWrong
+	}
+	return signer, err
+}
+
+// Reads an OpenSSH user certificate.
+func getCertificate(path string) (*ssh.Certificate, error) {
 	buf, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	return ssh.ParsePrivateKey(buf)
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok || cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s is not a user certificate", path)
+	}
+	return cert, nil
+}
+
+// findPrivateKeys returns all files in dir which contain a PEM encoded
+// private key.
+func findPrivateKeys(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		// follows symlinks, e.g. of mounted Kubernetes secrets
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		if isPrivateKeyFile(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// isPrivateKeyFile checks the first line of a file for a PEM header of a
+// private key.
+func isPrivateKeyFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	line, _ := bufio.NewReader(f).ReadSlice('\n')
+	return bytes.HasPrefix(line, []byte("-----BEGIN ")) &&
+		bytes.Contains(line, []byte("PRIVATE KEY-----"))
+}
+
+// keyPassphrase looks up the passphrase of an encrypted private key. For
+// a key file named "id_ed25519", the following sources are tried:
+//
+//   - the environment variable HOS_KEY_PASSPHRASE_ID_ED25519
+//   - the systemd credential "id_ed25519.passphrase"
+//   - the file "id_ed25519.passphrase" in the passphrase directory
+//
+// A trailing newline is removed from files.
+func keyPassphrase(path string) ([]byte, error) {
+	name := filepath.Base(path)
+
+	envName := "HOS_KEY_PASSPHRASE_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' {
+			return r - 'a' + 'A'
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	if passphrase, ok := os.LookupEnv(envName); ok {
+		return []byte(passphrase), nil
+	}
+
+	var dirs []string
+	if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if passphraseDir != "" {
+		dirs = append(dirs, passphraseDir)
+	}
+
+	for _, dir := range dirs {
+		file := filepath.Join(dir, name+".passphrase")
+		buf, err := os.ReadFile(file)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read passphrase: %w", err)
+		}
+		return []byte(strings.TrimRight(string(buf), "\r\n")), nil
+	}
+
+	return nil, errPassphraseMissing
 }
 
-func readPrivateKeys(paths ...string) (methods []ssh.AuthMethod) {
+// Reads SSH private key files along with their certificates, skipping
+// those which can't be loaded.
+func readPrivateKeys(paths ...string) (identities []*identity) {
 	for _, path := range paths {
-		if signer, err := getKeyFile(path); err == nil {
+		id, err := loadIdentity(path)
+		switch {
+		case err == nil:
 			log.Println("loaded private key", path)
-			methods = append(methods, ssh.PublicKeys(signer))
-		} else {
+			identities = append(identities, id)
+		case errors.Is(err, errPassphraseMissing), errors.Is(err, errPassphraseWrong):
+			log.Printf("unable to unlock private key %q: %v", path, err)
+		default:
 			log.Printf("unable to load private key %q: %v", path, err)
 		}
 	}
-	return methods
+	return identities
 }
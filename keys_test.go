@@ -1,18 +1,25 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 )
 
 func TestKeyFile(t *testing.T) {
 	t.Parallel()
 
-	_, err := getKeyFile("fixtures/id_ed25519")
+	_, err := loadIdentity("fixtures/id_ed25519")
 	assert.NoError(t, err)
 
-	_, err = getKeyFile("does-not-exist")
+	_, err = loadIdentity("does-not-exist")
 	assert.EqualError(t, err, "open does-not-exist: no such file or directory")
 }
 
@@ -22,3 +29,120 @@ func TestReadPrivateKeys(t *testing.T) {
 	keys := readPrivateKeys("does-not-exists", "fixtures/id_ed25519")
 	assert.Len(t, keys, 1)
 }
+
+func TestFindPrivateKeys(t *testing.T) {
+	t.Parallel()
+
+	paths, err := findPrivateKeys("fixtures")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fixtures/id_ed25519", "fixtures/id_ed25519_encrypted"}, paths)
+
+	_, err = findPrivateKeys("does-not-exist")
+	assert.Error(t, err)
+}
+
+// signUserCert creates a user certificate for the public key, signed by
+// a new CA.
+func signUserCert(t *testing.T, pub ssh.PublicKey, validBefore time.Time) *ssh.Certificate {
+	t.Helper()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+
+	cert := &ssh.Certificate{
+		Key:             pub,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"prometheus"},
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestKeyFileWithCertificate(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	id, err := loadIdentity("fixtures/id_ed25519")
+	require.NoError(err)
+	plain := id.signer
+
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	buf, err := os.ReadFile("fixtures/id_ed25519")
+	require.NoError(err)
+	require.NoError(os.WriteFile(path, buf, 0o600))
+
+	// certificate for another key
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(err)
+	otherPub, err := ssh.NewPublicKey(otherKey)
+	require.NoError(err)
+	other := signUserCert(t, otherPub, time.Now().Add(time.Hour))
+	require.NoError(os.WriteFile(path+"-cert.pub", ssh.MarshalAuthorizedKey(other), 0o600))
+	id, err = loadIdentity(path)
+	require.NoError(err)
+	assert.Equal(plain.PublicKey().Marshal(), id.signer.PublicKey().Marshal())
+
+	cert := signUserCert(t, plain.PublicKey(), time.Now().Add(time.Hour))
+	require.NoError(os.WriteFile(path+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0o600))
+
+	id, err = loadIdentity(path)
+	require.NoError(err)
+	assert.Equal(cert.Marshal(), id.signer.PublicKey().Marshal())
+
+	// not a certificate
+	require.NoError(os.WriteFile(path+"-cert.pub", ssh.MarshalAuthorizedKey(plain.PublicKey()), 0o600))
+	id, err = loadIdentity(path)
+	require.NoError(err)
+	assert.Equal(plain.PublicKey().Marshal(), id.signer.PublicKey().Marshal())
+}
+
+// copyKey copies the encrypted fixture (passphrase "secret") to path.
+func copyKey(t *testing.T, path string) {
+	t.Helper()
+
+	buf, err := os.ReadFile("fixtures/id_ed25519_encrypted")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, buf, 0o600))
+}
+
+func TestEncryptedKeyFile(t *testing.T) {
+	keyDir := t.TempDir()
+	credDir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", credDir)
+
+	oldPassphraseDir := passphraseDir
+	passphraseDir = t.TempDir()
+	defer func() { passphraseDir = oldPassphraseDir }()
+
+	fromEnv := filepath.Join(keyDir, "id_env-key")
+	copyKey(t, fromEnv)
+	t.Setenv("HOS_KEY_PASSPHRASE_ID_ENV_KEY", "secret")
+
+	fromCred := filepath.Join(keyDir, "id_cred")
+	copyKey(t, fromCred)
+	require.NoError(t, os.WriteFile(filepath.Join(credDir, "id_cred.passphrase"), []byte("not the secret\n"), 0o600))
+
+	fromDir := filepath.Join(keyDir, "id_dir")
+	copyKey(t, fromDir)
+	require.NoError(t, os.WriteFile(filepath.Join(passphraseDir, "id_dir.passphrase"), []byte("secret\n"), 0o600))
+
+	missing := filepath.Join(keyDir, "id_missing")
+	copyKey(t, missing)
+
+	_, err := loadIdentity(fromEnv)
+	assert.NoError(t, err)
+
+	_, err = loadIdentity(fromCred)
+	assert.ErrorIs(t, err, errPassphraseWrong)
+
+	_, err = loadIdentity(fromDir)
+	assert.NoError(t, err)
+
+	_, err = loadIdentity(missing)
+	assert.ErrorIs(t, err, errPassphraseMissing)
+}
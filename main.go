@@ -1,19 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var home = func() string {
@@ -26,21 +32,43 @@ var home = func() string {
 }()
 
 var (
-	sshKeyDir = envStr("HOS_KEY_DIR", filepath.Join(home, ".ssh"))
-	sshKeys   = []string{
-		filepath.Join(sshKeyDir, "id_rsa"),
-		filepath.Join(sshKeyDir, "id_ed25519"),
-	}
+	sshKeyDir  = envStr("HOS_KEY_DIR", filepath.Join(home, ".ssh"))
 	knownHosts = filepath.Join(sshKeyDir, "known_hosts")
 	proxy      *Proxy
 )
 
 // command line flags.
 var (
-	listen        = envStr("HOS_LISTEN", "[::1]:8080")
-	enableMetrics = envStr("HOS_METRICS", "1") != "0"
-	sshUser       = envStr("HOS_USER", "root")
-	sshTimeout    = envDur("HOS_TIMEOUT", 10*time.Second)
+	listen          = envStr("HOS_LISTEN", "[::1]:8080")
+	enableMetrics   = envStr("HOS_METRICS", "1") != "0"
+	sshUser         = envStr("HOS_USER", "root")
+	sshTimeout      = envDur("HOS_TIMEOUT", 10*time.Second)
+	idleTimeout     = envDur("HOS_IDLE_TIMEOUT", 5*time.Minute)
+	tlsConfigFile   = envStr("HOS_TLS_CONFIG", "")
+	sshConfigFile   = envStr("HOS_SSH_CONFIG", filepath.Join(sshKeyDir, "config"))
+	agentSocket     = envStrOrEmpty("HOS_AGENT_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	passphraseDir   = envStr("HOS_PASSPHRASE_DIR", "")
+	identities      = envList("HOS_IDENTITIES", "id_rsa", "id_ecdsa", "id_ed25519")
+	identityDir     = envStr("HOS_IDENTITY_DIR", "")
+	hostKeyPolicy   = envStr("HOS_HOST_KEY_POLICY", hostKeyPolicyStrict)
+	hostKeyPins     = strings.Fields(os.Getenv("HOS_HOST_KEY_PINS"))
+	hostCAFile      = envStr("HOS_HOST_CA", "")
+	revokedKeys     = envStr("HOS_REVOKED_HOST_KEYS", "")
+	passwordAuth    = envStr("HOS_PASSWORD_AUTH", "0") != "0"
+	keepalive       = envDur("HOS_KEEPALIVE_INTERVAL", 30*time.Second)
+	keepaliveMax    = envInt("HOS_KEEPALIVE_COUNT", 3)
+	backoff         = envDur("HOS_BACKOFF", time.Second)
+	maxBackoff      = envDur("HOS_MAX_BACKOFF", 5*time.Minute)
+	maxConns        = envInt("HOS_MAX_CONNECTIONS", 1)
+	maxChannels     = envInt("HOS_MAX_CHANNELS", 0)
+	shutdownTimeout = envDur("HOS_SHUTDOWN_TIMEOUT", 20*time.Second)
+	warmHosts       = strings.Fields(os.Getenv("HOS_WARM"))
+	warmFile        = envStr("HOS_WARM_FILE", "")
+	retries         = envInt("HOS_RETRIES", 1)
+	retryBudget     = envInt("HOS_RETRY_BUDGET", 10)
+	upgradeTimeout  = envDur("HOS_UPGRADE_IDLE_TIMEOUT", 5*time.Minute)
+	socksListen     = envStr("HOS_SOCKS_LISTEN", "")
+	viaSeparator    = envStr("HOS_VIA_SEPARATOR", defaultViaSeparator)
 )
 
 // build flags.
@@ -57,27 +85,90 @@ func main() {
 	flag.StringVar(&listen, "listen", listen, "listen on")
 	flag.StringVar(&sshUser, "user", sshUser, "default SSH username")
 	flag.DurationVar(&sshTimeout, "timeout", sshTimeout, "SSH connection timeout")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "close SSH connections after being idle (0 to disable)")
+	flag.StringVar(&tlsConfigFile, "tls-config", tlsConfigFile, "JSON file with TLS settings for HTTPS destinations")
+	flag.StringVar(&sshConfigFile, "ssh-config", sshConfigFile, "OpenSSH client configuration file")
+	flag.StringVar(&agentSocket, "agent", agentSocket, "ssh-agent socket (empty to disable)")
+	flag.StringVar(&passphraseDir, "passphrase-dir", passphraseDir, "directory with <key>.passphrase files for encrypted keys")
+	flag.Var(&listFlag{values: &identities}, "identity", "private key file, relative to the key directory (repeatable)")
+	flag.StringVar(&identityDir, "identity-dir", identityDir, "directory to load all private keys from")
+	flag.StringVar(&hostKeyPolicy, "host-key-policy", hostKeyPolicy, "host key policy: yes, accept-new, pinned or cert-authority")
+	flag.Var(&listFlag{values: &hostKeyPins}, "host-key-pin", "pinned host key fingerprint as host[:port]=SHA256:... (repeatable)")
+	flag.StringVar(&hostCAFile, "host-ca", hostCAFile, "file with trusted host CA keys")
+	flag.StringVar(&revokedKeys, "revoked-host-keys", revokedKeys, "KRL or list of revoked host keys")
+	flag.BoolVar(&passwordAuth, "password-auth", passwordAuth, "use the HTTP Basic Auth password for SSH password authentication")
+	flag.DurationVar(&keepalive, "keepalive-interval", keepalive, "interval of SSH keepalive requests (0 to disable)")
+	flag.IntVar(&keepaliveMax, "keepalive-count", keepaliveMax, "missed SSH keepalive replies until a connection is closed")
+	flag.DurationVar(&backoff, "backoff", backoff, "delay after a failed SSH connection, doubled for each failure (0 to disable)")
+	flag.DurationVar(&maxBackoff, "max-backoff", maxBackoff, "maximum delay after failed SSH connections")
+	flag.IntVar(&maxConns, "max-connections", maxConns, "maximum number of SSH connections per host")
+	flag.IntVar(&maxChannels, "max-channels", maxChannels, "maximum number of forwardings per SSH connection (0 for unlimited)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "time to wait for running requests and tunnels on SIGTERM")
+	flag.Var(&listFlag{values: &warmHosts}, "warm", "host to keep connected as [user@]host[:port], optionally preceded by jump hosts (repeatable)")
+	flag.StringVar(&warmFile, "warm-file", warmFile, "file with hosts to keep connected, one per line")
+	flag.IntVar(&retries, "retries", retries, "retries of GET and HEAD requests when their SSH connection dies")
+	flag.IntVar(&retryBudget, "retry-budget", retryBudget, "maximum retries per host and minute (0 for unlimited)")
+	flag.DurationVar(&upgradeTimeout, "upgrade-idle-timeout", upgradeTimeout, "close upgraded connections, e.g. WebSockets, after being idle (0 to disable)")
+	flag.StringVar(&socksListen, "socks-listen", socksListen, "listen for SOCKS5 connections on (empty to disable)")
+	flag.StringVar(&viaSeparator, "via-separator", viaSeparator, "separator of destination and jump host in CONNECT and SOCKS5 destinations")
 	flag.Parse()
 
 	log.SetFlags(log.Lshortfile)
 
-	authMethods := readPrivateKeys(sshKeys...)
-	if len(authMethods) == 0 {
-		log.Fatal("no SSH keys found")
+	var keyAgent *sshAgent
+	if agentSocket != "" {
+		keyAgent = newSSHAgent(agentSocket)
+		if agentSigners, err := keyAgent.Signers(); err == nil {
+			log.Printf("found %d keys in ssh-agent %s", len(agentSigners), agentSocket)
+		} else {
+			log.Printf("unable to connect to ssh-agent %s: %v", agentSocket, err)
+		}
+	}
+
+	settings, err := loadSSHSettings(keyAgent != nil)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	hostKeyCallback, err := knownhosts.New(knownHosts)
+	hosts, err := readSSHConfig(sshConfigFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	proxy = NewProxy()
-	proxy.sshConfig = ssh.ClientConfig{
-		Timeout:         sshTimeout,
-		User:            sshUser,
-		Auth:            authMethods,
-		HostKeyCallback: hostKeyCallback,
+	proxy.sshConfig.Store(settings)
+	proxy.agent = keyAgent
+	proxy.hosts = hosts
+	proxy.passwordAuth = passwordAuth
+	proxy.keepaliveInterval = keepalive
+	proxy.keepaliveCount = keepaliveMax
+	proxy.backoff = backoff
+	proxy.maxBackoff = maxBackoff
+	proxy.maxConns = maxConns
+	proxy.maxChannels = maxChannels
+	proxy.retries = retries
+	proxy.retryBudget = retryBudget
+	proxy.upgradeIdleTimeout = upgradeTimeout
+	proxy.viaSeparator = viaSeparator
+	go reloadOnHangup(proxy, keyAgent != nil)
+
+	if tlsConfigFile != "" {
+		proxy.tlsConfigs, err = loadTLSConfigs(tlsConfigFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if idleTimeout > 0 {
+		go proxy.reapIdle(idleTimeout)
+	}
+
+	warmKeys, err := loadWarmHosts()
+	if err != nil {
+		log.Fatal(err)
 	}
+	proxy.warm(warmKeys)
+	http.HandleFunc("/-/ready", proxy.ServeReady)
 
 	if enableMetrics {
 		prometheus.MustRegister(&metrics)
@@ -85,8 +176,187 @@ func main() {
 	}
 
 	http.Handle("/", proxy)
-	log.Println("listening on", listen)
-	log.Fatal(http.ListenAndServe(listen, nil))
+	server := &http.Server{Addr: listen, Handler: routeConnect(proxy, http.DefaultServeMux)}
+	go func() {
+		log.Println("listening on", listen)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	var socksListener net.Listener
+	socksDone := make(chan struct{})
+	if socksListen == "" {
+		close(socksDone)
+	} else {
+		socksListener, err = net.Listen("tcp", socksListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer close(socksDone)
+			log.Println("listening for SOCKS5 on", socksListen)
+			if err := proxy.serveSOCKS(socksListener); !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("shutting down, waiting up to %v for running requests and tunnels", shutdownTimeout)
+	if socksListener != nil {
+		socksListener.Close()
+	}
+	<-socksDone // no SOCKS connections are accepted afterwards
+	if err := shutdown(server, proxy, shutdownTimeout); err != nil {
+		log.Printf("shutdown incomplete: %v", err)
+		os.Exit(1)
+	}
+	log.Println("shutdown complete")
+}
+
+// shutdown stops accepting requests, waits up to timeout for running
+// requests and tunnels to finish and closes all SSH connections. An error
+// is returned if requests or tunnels had to be aborted.
+func shutdown(server *http.Server, proxy *Proxy, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	} else {
+		err = proxy.waitTunnels(ctx)
+	}
+
+	proxy.close()
+	return err
+}
+
+// loadSSHSettings reads the private keys, known hosts, host CAs and
+// revoked host keys.
+func loadSSHSettings(haveAgent bool) (*sshSettings, error) {
+	keys := newKeyring(identityFiles()...)
+	if keys.Len() == 0 && !haveAgent && !passwordAuth {
+		return nil, errors.New("no SSH keys found")
+	}
+
+	verifier, err := newHostKeyVerifier(hostKeyPolicy, knownHosts, hostKeyPins)
+	if err != nil {
+		return nil, err
+	}
+
+	if hostCAFile != "" {
+		verifier.authorities, err = readHostCAs(hostCAFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if hostKeyPolicy == hostKeyPolicyCertAuthority {
+		return nil, errors.New("host key policy cert-authority requires a host CA file")
+	}
+
+	if revokedKeys != "" {
+		verifier.revoked, err = readRevocationList(revokedKeys)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &sshSettings{
+		config: ssh.ClientConfig{
+			Timeout:         sshTimeout,
+			User:            sshUser,
+			HostKeyCallback: verifier.check,
+		},
+		keys: keys,
+	}, nil
+}
+
+// reloadOnHangup reloads the private keys and known hosts on SIGHUP. New
+// SSH connections use the new settings, established connections are kept.
+func reloadOnHangup(proxy *Proxy, haveAgent bool) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		settings, err := loadSSHSettings(haveAgent)
+		if err != nil {
+			log.Printf("reload failed, keeping previous keys and known hosts: %v", err)
+			continue
+		}
+		proxy.sshConfig.Store(settings)
+		log.Println("reloaded keys and known hosts")
+	}
+}
+
+// loadWarmHosts returns the hosts to keep connected.
+func loadWarmHosts() ([]clientKey, error) {
+	hosts := warmHosts
+	if warmFile != "" {
+		fromFile, err := readWarmHosts(warmFile)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, fromFile...)
+	}
+
+	keys := make([]clientKey, 0, len(hosts))
+	for _, host := range hosts {
+		key, err := parseHopChain(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host to keep connected %q: %w", host, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// identityFiles returns the paths of the configured private keys.
+func identityFiles() []string {
+	paths := make([]string, 0, len(identities))
+	for _, path := range identities {
+		path = expandHome(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(sshKeyDir, path)
+		}
+		paths = append(paths, path)
+	}
+
+	if identityDir != "" {
+		found, err := findPrivateKeys(identityDir)
+		if err != nil {
+			log.Printf("unable to search for private keys: %v", err)
+		}
+		paths = append(paths, found...)
+	}
+
+	return paths
+}
+
+// listFlag is a repeatable command line flag. The first occurrence
+// replaces the default values.
+type listFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *listFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ",")
+}
+
+func (f *listFlag) Set(value string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+	*f.values = append(*f.values, value)
+	return nil
 }
 
 func envStr(name, fallback string) string {
@@ -96,6 +366,29 @@ func envStr(name, fallback string) string {
 	return fallback
 }
 
+// envStrOrEmpty is like envStr, but keeps an empty value if the variable
+// is set.
+func envStrOrEmpty(name, fallback string) string {
+	if s, ok := os.LookupEnv(name); ok {
+		return s
+	}
+	return fallback
+}
+
+func envList(name string, fallback ...string) []string {
+	if s := os.Getenv(name); s != "" {
+		return filepath.SplitList(s)
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	if i, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return i
+	}
+	return fallback
+}
+
 func envDur(name string, fallback time.Duration) time.Duration {
 	if dur, err := time.ParseDuration(os.Getenv(name)); err == nil {
 		return dur
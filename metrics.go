@@ -1,42 +1,92 @@
 package main
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
 )
 
 type connectionStats struct {
 	established uint
 	failed      uint
+	reaped      uint
+	dead        uint // failed keepalives
+}
+
+// updated atomically
+type byteStats struct {
+	sent     uint64 // bytes to the destination
+	received uint64 // bytes from the destination
+}
+
+type retryStats struct {
+	retried   uint
+	exhausted uint // retry budget of the host exhausted
+}
+
+type hostKeyStats struct {
+	accepted  uint // found in known_hosts
+	learned   uint // added to known_hosts
+	pinned    uint // matching a pinned fingerprint
+	certified uint // signed by a trusted host CA
+	rejected  uint
 }
 
 type prometheusExporter struct {
-	certTTL *prometheus.Desc
-	connUp  *prometheus.Desc
-	conns   *prometheus.Desc
-	fwds    *prometheus.Desc
+	certTTL       *prometheus.Desc
+	clientCertTTL *prometheus.Desc
+	connUp        *prometheus.Desc
+	circuit       *prometheus.Desc
+	conns         *prometheus.Desc
+	fwds          *prometheus.Desc
+	hostKeyDesc   *prometheus.Desc
+	retryDesc     *prometheus.Desc
+	upgradeBytes  *prometheus.Desc
+	tunnelBytes   *prometheus.Desc
 
 	connections connectionStats
 	forwardings connectionStats
+	hostKeys    hostKeyStats
+	retries     retryStats
+	upgrades    byteStats
+	tunnels     byteStats
 }
 
 var (
-	connLabels = []string{"state"}
-	hostLabel  = []string{"host"}
+	connLabels     = []string{"state"}
+	hostLabel      = []string{"host"}
+	identityLabel  = []string{"identity"}
+	decisionLabel  = []string{"decision"}
+	directionLabel = []string{"direction"}
 )
 
 var metrics = prometheusExporter{
-	certTTL: prometheus.NewDesc("sshproxy_certificate_ttl", "TTL until SSH certificate expires", hostLabel, nil),
-	connUp:  prometheus.NewDesc("sshproxy_connection_up", "SSH connection up", hostLabel, nil),
-	conns:   prometheus.NewDesc("sshproxy_connections_total", "SSH connections", connLabels, nil),
-	fwds:    prometheus.NewDesc("sshproxy_forwardings_total", "TCP forwardings", connLabels, nil),
+	certTTL:       prometheus.NewDesc("sshproxy_certificate_ttl", "TTL until SSH certificate expires", hostLabel, nil),
+	clientCertTTL: prometheus.NewDesc("sshproxy_client_certificate_ttl_seconds", "Seconds until SSH client certificate expires", identityLabel, nil),
+	connUp:        prometheus.NewDesc("sshproxy_connection_up", "SSH connection up", hostLabel, nil),
+	circuit:       prometheus.NewDesc("sshproxy_circuit_state", "Circuit breaker state (0 closed, 1 half-open, 2 open)", hostLabel, nil),
+	conns:         prometheus.NewDesc("sshproxy_connections_total", "SSH connections", connLabels, nil),
+	fwds:          prometheus.NewDesc("sshproxy_forwardings_total", "TCP forwardings", connLabels, nil),
+	hostKeyDesc:   prometheus.NewDesc("sshproxy_host_keys_total", "Host key verifications", decisionLabel, nil),
+	retryDesc:     prometheus.NewDesc("sshproxy_retries_total", "Requests retried after their SSH connection died", connLabels, nil),
+	upgradeBytes:  prometheus.NewDesc("sshproxy_upgraded_bytes_total", "Bytes transferred over upgraded connections", directionLabel, nil),
+	tunnelBytes:   prometheus.NewDesc("sshproxy_tunneled_bytes_total", "Bytes transferred over tunnels", directionLabel, nil),
 }
 
 // Describe implements (part of the) prometheus.Collector interface.
 func (e *prometheusExporter) Describe(c chan<- *prometheus.Desc) {
 	c <- metrics.certTTL
+	c <- metrics.clientCertTTL
 	c <- metrics.connUp
+	c <- metrics.circuit
 	c <- metrics.conns
 	c <- metrics.fwds
+	c <- metrics.hostKeyDesc
+	c <- metrics.retryDesc
+	c <- metrics.upgradeBytes
+	c <- metrics.tunnelBytes
 }
 
 // Collect implements (part of the) prometheus.Collector interface.
@@ -47,23 +97,61 @@ func (e prometheusExporter) Collect(c chan<- prometheus.Metric) {
 
 	c <- met(metrics.conns, C, float64(e.connections.established), "established")
 	c <- met(metrics.conns, C, float64(e.connections.failed), "failed")
+	c <- met(metrics.conns, C, float64(e.connections.reaped), "reaped")
+	c <- met(metrics.conns, C, float64(e.connections.dead), "dead")
 	c <- met(metrics.fwds, C, float64(e.forwardings.established), "established")
 	c <- met(metrics.fwds, C, float64(e.forwardings.failed), "failed")
+	c <- met(metrics.hostKeyDesc, C, float64(e.hostKeys.accepted), "accepted")
+	c <- met(metrics.hostKeyDesc, C, float64(e.hostKeys.learned), "learned")
+	c <- met(metrics.hostKeyDesc, C, float64(e.hostKeys.pinned), "pinned")
+	c <- met(metrics.hostKeyDesc, C, float64(e.hostKeys.certified), "certificate")
+	c <- met(metrics.hostKeyDesc, C, float64(e.hostKeys.rejected), "rejected")
+	c <- met(metrics.retryDesc, C, float64(e.retries.retried), "retried")
+	c <- met(metrics.retryDesc, C, float64(e.retries.exhausted), "exhausted")
+	c <- met(metrics.upgradeBytes, C, float64(atomic.LoadUint64(&metrics.upgrades.sent)), "sent")
+	c <- met(metrics.upgradeBytes, C, float64(atomic.LoadUint64(&metrics.upgrades.received)), "received")
+	c <- met(metrics.tunnelBytes, C, float64(atomic.LoadUint64(&metrics.tunnels.sent)), "sent")
+	c <- met(metrics.tunnelBytes, C, float64(atomic.LoadUint64(&metrics.tunnels.received)), "received")
+
+	// clients with different passwords share the same label
+	up := make(map[string]float64)
+	circuits := make(map[string]int)
+	certs := make(map[string]*ssh.Certificate)
 
 	proxy.mtx.Lock()
 	for key, client := range proxy.clients {
 		host := key.String()
 
-		var up float64
-		if client.sshClient != nil {
-			up = 1
+		client.mtx.Lock()
+		if len(client.conns) > 0 {
+			up[host] = 1
+		} else if _, ok := up[host]; !ok {
+			up[host] = 0
 		}
-		c <- met(metrics.connUp, G, up, host)
 
 		if cert := client.sshCert; cert != nil {
-			ttl := float64(cert.ValidBefore)
-			c <- met(metrics.certTTL, G, ttl, host)
+			certs[host] = cert
 		}
+
+		circuits[host] = max(circuits[host], client.circuitState())
+		client.mtx.Unlock()
 	}
 	proxy.mtx.Unlock()
+
+	for host, up := range up {
+		c <- met(metrics.connUp, G, up, host)
+	}
+	for host, state := range circuits {
+		c <- met(metrics.circuit, G, float64(state), host)
+	}
+	for host, cert := range certs {
+		c <- met(metrics.certTTL, G, float64(cert.ValidBefore), host)
+	}
+
+	for path, cert := range proxy.clientCertificates() {
+		if validBefore := certValidBefore(cert); !validBefore.IsZero() {
+			ttl := time.Until(validBefore).Seconds()
+			c <- met(metrics.clientCertTTL, G, ttl, path)
+		}
+	}
 }
@@ -1,66 +1,335 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"log"
+	"maps"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// idleConnTimeout closes idle HTTP connections to destinations, which
+// hold an SSH channel each.
+const idleConnTimeout = 90 * time.Second
+
 // Proxy holds the HTTP client and the SSH connection pool.
 type Proxy struct {
-	clients   map[clientKey]*client
-	sshConfig ssh.ClientConfig
-	mtx       sync.Mutex
+	clients    map[clientKey]*client
+	sshConfig  atomic.Pointer[sshSettings]
+	agent      *sshAgent      // may be nil
+	hosts      *openSSHConfig // per-host settings, may be nil
+	tlsConfigs tlsConfigs
+	// use the password of HTTP Basic Auth for SSH authentication
+	passwordAuth bool
+	// keepalive requests are sent every interval (0 to disable), a
+	// connection is considered dead after count missed replies
+	keepaliveInterval time.Duration
+	keepaliveCount    int
+	// delay after the first failed handshake (0 to disable the circuit
+	// breaker), doubled for each further failure up to maxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// SSH connections per client (at least 1) and channels per connection
+	// (0 for unlimited)
+	maxConns    int
+	maxChannels int
+	// GET and HEAD requests are retried up to retries times when their SSH
+	// connection dies, with at most retryBudget retries per host and minute
+	// (0 for unlimited)
+	retries     int
+	retryBudget int
+	// upgraded connections, e.g. WebSockets, are closed after being idle
+	// (0 to disable)
+	upgradeIdleTimeout time.Duration
+	// separates destination and jump host in tunnel destinations (empty
+	// to disable)
+	viaSeparator string
+	warmClients  []*client      // kept connected, protected by mtx
+	tunnels      sync.WaitGroup // hijacked connections, see trackTunnel
+	done         chan struct{}  // closed by close
+	closeOnce    sync.Once
+	mtx          sync.Mutex
+}
+
+// sshSettings holds the key material and host key verification used for
+// new SSH connections. It is replaced as a whole on reload, established
+// connections are not affected.
+type sshSettings struct {
+	config ssh.ClientConfig
+	keys   *keyring // default private keys
 }
 
 // NewProxy creates a new proxy.
 func NewProxy() *Proxy {
-	return &Proxy{
-		clients: make(map[clientKey]*client),
+	proxy := &Proxy{
+		clients:      make(map[clientKey]*client),
+		done:         make(chan struct{}),
+		viaSeparator: defaultViaSeparator,
 	}
+	proxy.sshConfig.Store(&sshSettings{})
+	return proxy
 }
 
-// getClient returns a (un)connected SSH client.
+// getClient returns a (un)connected SSH client. The client is marked as
+// being in use until it is passed to releaseClient.
 func (proxy *Proxy) getClient(key clientKey) *client {
 	proxy.mtx.Lock()
 	defer proxy.mtx.Unlock()
 
+	return proxy.getClientLocked(key)
+}
+
+// getClientLocked is getClient for callers holding proxy.mtx. Clients for
+// jump hosts are pooled under their own key and stay in use as long as a
+// client depending on them exists.
+func (proxy *Proxy) getClientLocked(key clientKey) *client {
 	// connection established?
 	pClient := proxy.clients[key]
 	if pClient != nil {
+		pClient.active++
+		pClient.lastUsed = time.Now()
 		return pClient
 	}
 
+	hc := proxy.hosts.lookup(key.host)
 	pClient = &client{
-		key:       key,
-		sshConfig: proxy.sshConfig, // make copy
-	}
-	pClient.sshConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		if err := proxy.sshConfig.HostKeyCallback(hostname, remote, key); err != nil {
-			return err
-		}
-		if cert, ok := key.(*ssh.Certificate); ok && cert != nil {
-			pClient.sshCert = cert
-		}
-		return nil
+		key:        key,
+		addr:       resolveAddr(key, &hc),
+		host:       hc,
+		proxy:      proxy,
+		tlsConfigs: proxy.tlsConfigs,
 	}
 
 	if key.username != "" {
-		pClient.sshConfig.User = key.username
+		pClient.user = key.username
+	} else {
+		pClient.user = hc.User
 	}
+
 	pClient.httpClient = &http.Client{
 		Transport: &http.Transport{
-			Dial: pClient.dial,
-			DialTLS: func(network, addr string) (net.Conn, error) {
-				return nil, errors.New("not implemented")
-			},
+			DialContext:     cancelWithRequest(pClient.dial),
+			DialTLSContext:  cancelWithRequest(pClient.dialTLS),
+			IdleConnTimeout: idleConnTimeout,
 		},
 	}
 
+	jumpKey := key
+	if jumpKey.jump == "" {
+		var err error
+		if jumpKey.jump, err = proxy.hosts.jump(key.host, 0); err != nil {
+			log.Println(err)
+		}
+	}
+	if parentKey, ok := jumpKey.parent(); ok {
+		pClient.parent = proxy.getClientLocked(parentKey)
+	}
+
 	// set and return the new connection
+	pClient.active = 1
+	pClient.lastUsed = time.Now()
 	proxy.clients[key] = pClient
 	return pClient
 }
+
+// cancelWithRequest aborts a dial when the request which caused it is
+// canceled. http.Transport detaches dials from the request, so that other
+// requests may use the connection, but SSH handshakes and forwardings
+// should not outlive the scrape waiting for them.
+func cancelWithRequest(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		reqCtx, ok := ctx.Value(requestContextKey{}).(context.Context)
+		if !ok {
+			return dial(ctx, network, address)
+		}
+
+		ctx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		stop := context.AfterFunc(reqCtx, func() { cancel(context.Cause(reqCtx)) })
+		defer stop()
+
+		return dial(ctx, network, address)
+	}
+}
+
+// backoffDelay returns how long to wait before the next handshake after
+// the given number of consecutive failures.
+func (proxy *Proxy) backoffDelay(failures int) time.Duration {
+	delay := proxy.backoff
+	for i := 1; i < failures && delay < proxy.maxBackoff; i++ {
+		delay *= 2
+	}
+	if proxy.maxBackoff > 0 {
+		delay = min(delay, proxy.maxBackoff)
+	}
+	return delay
+}
+
+// publicKeys returns an AuthMethod offering the given host specific keys,
+// the default keys and the keys held by the ssh-agent, in this order.
+// All keys need to be combined, as only the first "publickey" method is
+// ever tried. The keys are collected for each connection attempt, so that
+// renewed certificates are picked up.
+func publicKeys(hostKeys, keys *keyring, agent *sshAgent) ssh.AuthMethod {
+	if hostKeys.Len() == 0 && keys.Len() == 0 && agent == nil {
+		return nil
+	}
+
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers := append(hostKeys.Signers(), keys.Signers()...)
+		if agent != nil {
+			agentSigners, err := agent.Signers()
+			if err != nil {
+				log.Printf("unable to get keys from ssh-agent: %v", err)
+			}
+			signers = append(signers, agentSigners...)
+		}
+		return signers, nil
+	})
+}
+
+// passwordAuthMethods returns the password and keyboard-interactive auth methods
+// for the given password. Keyboard-interactive prompts without echo are
+// answered with the password, others with an empty string.
+func passwordAuthMethods(password string) []ssh.AuthMethod {
+	return []ssh.AuthMethod{
+		ssh.Password(password),
+		ssh.KeyboardInteractive(func(_, _ string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range questions {
+				if !echos[i] {
+					answers[i] = password
+				}
+			}
+			return answers, nil
+		}),
+	}
+}
+
+// resolveAddr returns the address to connect to, with the HostName and
+// Port settings applied. An explicit port in the key takes precedence.
+func resolveAddr(key clientKey, hc *sshHostConfig) string {
+	host := key.host
+	if hc.HostName != "" {
+		host = hc.HostName
+	}
+
+	port := key.port
+	if port == defaultPort && hc.Port != 0 {
+		port = hc.Port
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// releaseClient marks a client obtained by getClient as no longer in use.
+func (proxy *Proxy) releaseClient(client *client) {
+	proxy.mtx.Lock()
+	defer proxy.mtx.Unlock()
+
+	client.active--
+	client.lastUsed = time.Now()
+}
+
+// reapIdleClients closes and removes all clients which are not in use
+// and have not been used for the given duration. Clients which are
+// currently dialing are in use and therefore left alone.
+func (proxy *Proxy) reapIdleClients(timeout time.Duration) {
+	var idle []*client
+
+	proxy.mtx.Lock()
+	for key, client := range proxy.clients {
+		if client.active > 0 || time.Since(client.lastUsed) < timeout {
+			continue
+		}
+
+		delete(proxy.clients, key)
+		if parent := client.parent; parent != nil {
+			parent.active--
+			parent.lastUsed = time.Now()
+		}
+		idle = append(idle, client)
+	}
+	proxy.mtx.Unlock()
+
+	// closing may block on stalled connections, and clients are closed
+	// before their jump hosts
+	slices.SortFunc(idle, func(a, b *client) int {
+		return b.hops() - a.hops()
+	})
+	for _, client := range idle {
+		connected := client.isConnected()
+		client.close()
+		if connected {
+			metrics.connections.reaped++
+			log.Printf("SSH connection to %s closed after being idle", client.key.String())
+		}
+	}
+}
+
+// reapIdle periodically removes clients which have been idle for longer
+// than the given timeout. It never returns.
+func (proxy *Proxy) reapIdle(timeout time.Duration) {
+	for range time.Tick(timeout / 2) {
+		proxy.reapIdleClients(timeout)
+	}
+}
+
+// context returns a context which is cancelled when the proxy is closed.
+func (proxy *Proxy) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-proxy.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// clientCertificates returns the current certificates of the default keys
+// and the host specific keys by key file.
+func (proxy *Proxy) clientCertificates() map[string]*ssh.Certificate {
+	keyrings := []*keyring{proxy.sshConfig.Load().keys}
+
+	proxy.mtx.Lock()
+	for _, client := range proxy.clients {
+		client.mtx.Lock()
+		keyrings = append(keyrings, client.hostKeys)
+		client.mtx.Unlock()
+	}
+	proxy.mtx.Unlock()
+
+	// certificates are reloaded from disk, without holding the proxy lock
+	certs := make(map[string]*ssh.Certificate)
+	for _, keys := range keyrings {
+		maps.Copy(certs, keys.certificates())
+	}
+	return certs
+}
+
+// close closes all clients. Clients are closed before the jump hosts they
+// are connected through.
+func (proxy *Proxy) close() {
+	proxy.closeOnce.Do(func() { close(proxy.done) })
+
+	proxy.mtx.Lock()
+	clients := slices.Collect(maps.Values(proxy.clients))
+	clear(proxy.clients)
+	proxy.mtx.Unlock()
+
+	slices.SortFunc(clients, func(a, b *client) int {
+		return b.hops() - a.hops()
+	})
+	for _, client := range clients {
+		client.close()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// do sends the request through the client. Requests without side effects
+// are retried on a new SSH connection when the SSH connection dies while
+// waiting for the response. It returns the number of retries.
+func (proxy *Proxy) do(client *client, r *http.Request) (*http.Response, int, error) {
+	for retries := 0; ; retries++ {
+		var conn net.Conn
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+		}
+
+		res, err := client.httpClient.Do(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+		if err == nil || retries >= proxy.retries || !isIdempotent(r) || r.Context().Err() != nil {
+			return res, retries, err
+		}
+
+		// was the request sent over an SSH connection which has died since?
+		if !client.discardDead(conn) || !client.takeRetry() {
+			return res, retries, err
+		}
+		log.Printf("retrying %s %s via %s: %v", r.Method, r.URL, client.key.String(), err)
+	}
+}
+
+// isIdempotent checks whether a request may be sent again.
+func isIdempotent(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		(r.Body == nil || r.Body == http.NoBody)
+}
+
+// discardDead discards the SSH connection of a forwarded connection, if it
+// is no longer alive. It reports whether the SSH connection was dead.
+func (client *client) discardDead(conn net.Conn) bool {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	fwd, ok := conn.(*forwardedConn)
+	if !ok || isAlive(fwd.ssh.Client) {
+		return false
+	}
+
+	if client.discard(fwd.ssh) {
+		log.Printf("SSH connection to %s died during a request", client.key.String())
+	}
+	return true
+}
+
+// takeRetry reports whether the retry budget of the client allows another
+// retry. The budget is refilled continuously, by retryBudget per minute.
+func (client *client) takeRetry() bool {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+
+	if budget := float64(client.proxy.retryBudget); budget > 0 {
+		now := time.Now()
+		if client.refilled.IsZero() {
+			client.tokens = budget
+		} else {
+			client.tokens = min(budget, client.tokens+now.Sub(client.refilled).Minutes()*budget)
+		}
+		client.refilled = now
+
+		if client.tokens < 1 {
+			metrics.retries.exhausted++
+			return false
+		}
+		client.tokens--
+	}
+
+	metrics.retries.retried++
+	return true
+}
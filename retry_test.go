@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+	proxy.retries = 1
+	proxy.retryBudget = 2
+	defer proxy.close()
+
+	key := clientKey{host: "127.0.0.1", port: sshPort}
+	client := proxy.getClient(key)
+	proxy.releaseClient(client)
+
+	// http.Transport itself retries requests on reused connections
+	client.httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+
+	// the SSH connection dies while the request is handled
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			client.mtx.Lock()
+			conns := slices.Clone(client.conns)
+			client.mtx.Unlock()
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	request := func(method string, n int32) *httptest.ResponseRecorder {
+		failures.Store(n)
+		w := httptest.NewRecorder()
+		uri := fmt.Sprintf("http://%s/%s/", key.hostPort(), server.Listener.Addr())
+		proxy.ServeHTTP(w, httptest.NewRequest(method, uri, nil))
+		return w
+	}
+
+	w := request(http.MethodGet, 0)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Empty(w.Header().Get("X-Proxy-Retries"))
+
+	w = request(http.MethodGet, 1)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("ok", w.Body.String())
+	assert.Equal("1", w.Header().Get("X-Proxy-Retries"))
+
+	// not idempotent
+	w = request(http.MethodPost, 1)
+	assert.Equal(http.StatusBadGateway, w.Code)
+	assert.Empty(w.Header().Get("X-Proxy-Retries"))
+
+	// retries exhausted
+	w = request(http.MethodGet, 2)
+	assert.Equal(http.StatusBadGateway, w.Code)
+	assert.Equal("1", w.Header().Get("X-Proxy-Retries"))
+
+	// retry budget exhausted
+	w = request(http.MethodHead, 1)
+	assert.Equal(http.StatusBadGateway, w.Code)
+	assert.Empty(w.Header().Get("X-Proxy-Retries"))
+}
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	proxy := NewProxy()
+	unlimited := &client{proxy: proxy}
+	for range 5 {
+		assert.True(unlimited.takeRetry())
+	}
+
+	proxy.retryBudget = 2
+	c := &client{proxy: proxy}
+	assert.True(c.takeRetry())
+	assert.True(c.takeRetry())
+	assert.False(c.takeRetry())
+
+	// refilled by one after half a minute
+	c.refilled = c.refilled.Add(-30 * time.Second)
+	assert.True(c.takeRetry())
+	assert.False(c.takeRetry())
+
+	// never more than the budget
+	c.refilled = c.refilled.Add(-time.Hour)
+	assert.True(c.takeRetry())
+	assert.True(c.takeRetry())
+	assert.False(c.takeRetry())
+}
+
+func TestIsIdempotent(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	assert.True(isIdempotent(httptest.NewRequest(http.MethodGet, "/", nil)))
+	assert.True(isIdempotent(httptest.NewRequest(http.MethodHead, "/", nil)))
+	assert.False(isIdempotent(httptest.NewRequest(http.MethodPost, "/", nil)))
+	assert.False(isIdempotent(httptest.NewRequest(http.MethodGet, "/", strings.NewReader("body"))))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1" //nolint:gosec // KRLs reference keys by SHA1 hashes
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KRL format, see PROTOCOL.krl in the OpenSSH sources.
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates  = 1
+	krlSectionExplicitKey   = 2
+	krlSectionSHA1          = 3
+	krlSectionSignature     = 4
+	krlSectionSHA256        = 5
+	krlCertSerialList       = 0x20
+	krlCertSerialRange      = 0x21
+	krlCertSerialBitmap     = 0x22
+	krlCertKeyID            = 0x23
+	krlMaxBitmapSerialCount = 1 << 20
+)
+
+var errKRLTruncated = errors.New("truncated KRL")
+
+// revocationList holds revoked keys and certificates. It is read from an
+// OpenSSH key revocation list (KRL) or from a plain list of public keys,
+// like OpenSSH's RevokedHostKeys.
+type revocationList struct {
+	keys   map[string]bool // marshaled public keys
+	sha1   map[[sha1.Size]byte]bool
+	sha256 map[[sha256.Size]byte]bool
+	certs  []*krlCerts
+}
+
+// krlCerts holds the revoked certificates of one CA.
+type krlCerts struct {
+	ca      []byte // marshaled CA key, nil for any CA
+	serials map[uint64]bool
+	ranges  [][2]uint64
+	keyIDs  map[string]bool
+}
+
+// readRevocationList reads a KRL or a list of public keys.
+func readRevocationList(file string) (*revocationList, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &revocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[[sha1.Size]byte]bool),
+		sha256: make(map[[sha256.Size]byte]bool),
+	}
+
+	if bytes.HasPrefix(buf, []byte(krlMagic)) {
+		err = list.parseKRL(buf[len(krlMagic):])
+	} else {
+		err = list.parseKeys(buf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+	return list, nil
+}
+
+// parseKeys parses public keys in authorized_keys format.
+func (list *revocationList) parseKeys(buf []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		list.keys[string(key.Marshal())] = true
+	}
+	return scanner.Err()
+}
+
+// parseKRL parses a binary KRL without its magic.
+func (list *revocationList) parseKRL(buf []byte) error {
+	r := krlReader{buf: buf}
+
+	if version := r.uint32(); version != krlFormatVersion {
+		if r.err != nil {
+			return r.err
+		}
+		return fmt.Errorf("unsupported KRL format version %d", version)
+	}
+	r.uint64() // krl_version
+	r.uint64() // generated_date
+	r.uint64() // flags
+	r.string() // reserved
+	r.string() // comment
+
+	for r.err == nil && len(r.buf) > 0 {
+		sectionType := r.byte()
+		data := r.string()
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case krlSectionCertificates:
+			if err := list.parseCertSection(data); err != nil {
+				return err
+			}
+		case krlSectionExplicitKey:
+			sr := krlReader{buf: data}
+			for sr.err == nil && len(sr.buf) > 0 {
+				list.keys[string(sr.string())] = true
+			}
+			r.err = sr.err
+		case krlSectionSHA1:
+			sr := krlReader{buf: data}
+			for sr.err == nil && len(sr.buf) > 0 {
+				var hash [sha1.Size]byte
+				copy(hash[:], sr.string())
+				list.sha1[hash] = true
+			}
+			r.err = sr.err
+		case krlSectionSHA256:
+			sr := krlReader{buf: data}
+			for sr.err == nil && len(sr.buf) > 0 {
+				var hash [sha256.Size]byte
+				copy(hash[:], sr.string())
+				list.sha256[hash] = true
+			}
+			r.err = sr.err
+		case krlSectionSignature:
+			// signatures are not verified, they always come last
+			return r.err
+		default:
+			return fmt.Errorf("unsupported KRL section type %d", sectionType)
+		}
+	}
+
+	return r.err
+}
+
+func (list *revocationList) parseCertSection(data []byte) error {
+	r := krlReader{buf: data}
+	certs := &krlCerts{
+		ca:      r.string(),
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+	r.string() // reserved
+
+	if len(certs.ca) == 0 {
+		certs.ca = nil
+	}
+
+	for r.err == nil && len(r.buf) > 0 {
+		sectionType := r.byte()
+		sr := krlReader{buf: r.string()}
+		if r.err != nil {
+			break
+		}
+
+		switch sectionType {
+		case krlCertSerialList:
+			for sr.err == nil && len(sr.buf) > 0 {
+				certs.serials[sr.uint64()] = true
+			}
+		case krlCertSerialRange:
+			certs.ranges = append(certs.ranges, [2]uint64{sr.uint64(), sr.uint64()})
+		case krlCertSerialBitmap:
+			offset := sr.uint64()
+			bitmap := new(big.Int).SetBytes(sr.string())
+			if bitmap.BitLen() > krlMaxBitmapSerialCount {
+				return errors.New("KRL serial bitmap too large")
+			}
+			for i := range bitmap.BitLen() {
+				if bitmap.Bit(i) == 1 {
+					certs.serials[offset+uint64(i)] = true
+				}
+			}
+		case krlCertKeyID:
+			for sr.err == nil && len(sr.buf) > 0 {
+				certs.keyIDs[string(sr.string())] = true
+			}
+		default:
+			return fmt.Errorf("unsupported KRL certificate section type %#x", sectionType)
+		}
+
+		if sr.err != nil {
+			return sr.err
+		}
+	}
+
+	list.certs = append(list.certs, certs)
+	return r.err
+}
+
+// isRevokedKey checks whether a plain key is revoked.
+func (list *revocationList) isRevokedKey(key ssh.PublicKey) bool {
+	if list == nil {
+		return false
+	}
+
+	blob := key.Marshal()
+	return list.keys[string(blob)] ||
+		list.sha1[sha1.Sum(blob)] || //nolint:gosec // see above
+		list.sha256[sha256.Sum256(blob)]
+}
+
+// isRevoked checks whether a key or certificate is revoked. Certificates
+// are revoked if their key, their CA or the certificate itself is revoked.
+func (list *revocationList) isRevoked(key ssh.PublicKey) bool {
+	if list == nil {
+		return false
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return list.isRevokedKey(key)
+	}
+
+	if list.isRevokedKey(cert.Key) || list.isRevokedKey(cert.SignatureKey) {
+		return true
+	}
+
+	ca := cert.SignatureKey.Marshal()
+	for _, certs := range list.certs {
+		if certs.ca != nil && !bytes.Equal(certs.ca, ca) {
+			continue
+		}
+		if certs.serials[cert.Serial] || certs.keyIDs[cert.KeyId] {
+			return true
+		}
+		for _, r := range certs.ranges {
+			if cert.Serial >= r[0] && cert.Serial <= r[1] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// krlReader decodes the SSH wire format. The first error is kept and
+// makes all further reads return zero values.
+type krlReader struct {
+	buf []byte
+	err error
+}
+
+func (r *krlReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errKRLTruncated
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *krlReader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *krlReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *krlReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *krlReader) string() []byte {
+	n := r.uint32()
+	if r.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(r.buf)) {
+		r.err = errKRLTruncated
+		return nil
+	}
+	return r.next(int(n))
+}
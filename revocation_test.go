@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func readPublicKey(t *testing.T, file string) ssh.PublicKey {
+	t.Helper()
+
+	buf, err := os.ReadFile(file)
+	require.NoError(t, err)
+	key, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	require.NoError(t, err)
+	return key
+}
+
+func TestRevocationListKRL(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	// generated by ssh-keygen -k, see the fixtures
+	list, err := readRevocationList("fixtures/hostkeys/revoked_host_keys.krl")
+	require.NoError(err)
+
+	ca := readPublicKey(t, "fixtures/hostkeys/host_ca.pub")
+	revoked := readPublicKey(t, "fixtures/hostkeys/host_key_revoked.pub")
+	hashed := readPublicKey(t, "fixtures/hostkeys/host_key_hashed.pub")
+	other := newTestHostKey(t)
+
+	assert.True(list.isRevoked(revoked))
+	assert.True(list.isRevoked(hashed))
+	assert.False(list.isRevoked(other))
+
+	cert := func(serial uint64, keyID string, signatureKey ssh.PublicKey) *ssh.Certificate {
+		return &ssh.Certificate{Key: other, Serial: serial, KeyId: keyID, SignatureKey: signatureKey}
+	}
+
+	for serial, expected := range map[uint64]bool{1: false, 5: true, 9: false, 10: true, 15: true, 20: true, 21: false} {
+		assert.Equal(expected, list.isRevoked(cert(serial, "", ca)), "serial %d", serial)
+	}
+	assert.True(list.isRevoked(cert(1, "revoked-id", ca)))
+
+	// serials and key IDs are revoked for the given CA only
+	assert.False(list.isRevoked(cert(5, "revoked-id", newTestHostKey(t))))
+
+	// certificates for revoked keys are revoked as well
+	assert.True(list.isRevoked(&ssh.Certificate{Key: revoked, Serial: 1, SignatureKey: ca}))
+}
+
+func TestRevocationListKeys(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	revoked := newTestHostKey(t)
+	other := newTestHostKey(t)
+
+	file := filepath.Join(t.TempDir(), "revoked")
+	require.NoError(os.WriteFile(file, append([]byte("# revoked keys\n\n"), ssh.MarshalAuthorizedKey(revoked)...), 0o600))
+
+	list, err := readRevocationList(file)
+	require.NoError(err)
+	assert.True(list.isRevoked(revoked))
+	assert.False(list.isRevoked(other))
+
+	// revoked CA
+	assert.True(list.isRevoked(&ssh.Certificate{Key: other, SignatureKey: revoked}))
+
+	var nilList *revocationList
+	assert.False(nilList.isRevoked(revoked))
+}
+
+func TestRevocationListErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+		return file
+	}
+
+	_, err := readRevocationList(write("invalid", "ssh-ed25519 invalid\n"))
+	assert.ErrorContains(t, err, "line 1:")
+
+	_, err = readRevocationList(write("truncated", krlMagic+"\x00\x00\x00\x01\x00"))
+	assert.ErrorIs(t, err, errKRLTruncated)
+
+	_, err = readRevocationList(write("version", krlMagic+"\x00\x00\x00\x02"))
+	assert.ErrorContains(t, err, "unsupported KRL format version 2")
+
+	_, err = readRevocationList(filepath.Join(dir, "does-not-exist"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
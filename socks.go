@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SOCKS5 protocol, see RFC 1928 and RFC 1929.
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthUnacceptable = 0xff
+
+	socksCmdConnect = 1
+
+	socksAddrIPv4   = 1
+	socksAddrDomain = 3
+	socksAddrIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksConnectionRefused  = 5
+	socksCommandUnsupported = 7
+	socksAddressUnsupported = 8
+)
+
+// time for a SOCKS client to send its request.
+const socksNegotiationTimeout = 30 * time.Second
+
+// socksError is a failed SOCKS request, with the reply code to send.
+type socksError struct {
+	reply byte
+	err   error
+}
+
+func (e *socksError) Error() string {
+	return e.err.Error()
+}
+
+func (e *socksError) Unwrap() error {
+	return e.err
+}
+
+// serveSOCKS accepts SOCKS5 connections until the listener is closed. The
+// connections are tracked as tunnels, see trackTunnel.
+func (proxy *Proxy) serveSOCKS(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		done := proxy.trackTunnel()
+		go func() {
+			defer done()
+			proxy.handleSOCKS(conn)
+		}()
+	}
+}
+
+// handleSOCKS tunnels a SOCKS5 connection to its destination through SSH.
+// The jump host is selected like for CONNECT requests, see tunnelKey.
+func (proxy *Proxy) handleSOCKS(conn net.Conn) {
+	defer conn.Close()
+
+	deadline := time.Now().Add(socksNegotiationTimeout)
+	_ = conn.SetDeadline(deadline)
+	r := bufio.NewReader(conn)
+
+	fail := func(err error) {
+		var socksErr *socksError
+		if errors.As(err, &socksErr) {
+			_ = socksReply(conn, socksErr.reply)
+		}
+		log.Printf("SOCKS connection from %s failed: %v", conn.RemoteAddr(), err)
+	}
+
+	username, password, ok, err := socksAuthenticate(r, conn)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	host, port, err := readSOCKSRequest(r)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	key, host, err := proxy.tunnelKey(host, username)
+	if err != nil {
+		fail(&socksError{socksNotAllowed, err})
+		return
+	}
+
+	if ok && proxy.passwordAuth {
+		key.password = password
+	}
+
+	client := proxy.getClient(key)
+	defer proxy.releaseClient(client)
+
+	// waiting for a free channel counts towards the negotiation
+	ctx, cancel := proxy.context()
+	defer cancel()
+	ctx, cancelDial := context.WithDeadline(ctx, deadline)
+	defer cancelDial()
+
+	backend, err := client.dial(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		reply := byte(socksGeneralFailure)
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			reply = socksConnectionRefused
+		}
+		fail(&socksError{reply, err})
+		return
+	}
+	defer backend.Close()
+
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	pipe(conn, r, backend, 0, &metrics.tunnels)
+}
+
+// socksAuthenticate negotiates the authentication method and returns the
+// credentials, if the client has sent any.
+func socksAuthenticate(r *bufio.Reader, w io.Writer) (string, string, bool, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", "", false, err
+	}
+	if header[0] != socksVersion {
+		return "", "", false, fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return "", "", false, err
+	}
+
+	method := byte(socksAuthUnacceptable)
+	for _, m := range methods {
+		if m == socksAuthPassword || (m == socksAuthNone && method != socksAuthPassword) {
+			method = m
+		}
+	}
+	if _, err := w.Write([]byte{socksVersion, method}); err != nil {
+		return "", "", false, err
+	}
+
+	switch method {
+	case socksAuthNone:
+		return "", "", false, nil
+	case socksAuthPassword:
+		// see below
+	default:
+		return "", "", false, errors.New("no acceptable authentication method")
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return "", "", false, err
+	}
+	if version != socksAuthVersion {
+		return "", "", false, fmt.Errorf("unsupported SOCKS authentication version %d", version)
+	}
+	username, err := readSOCKSString(r)
+	if err != nil {
+		return "", "", false, err
+	}
+	password, err := readSOCKSString(r)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	// the jump host is checked with the request
+	if _, err := w.Write([]byte{socksAuthVersion, socksSucceeded}); err != nil {
+		return "", "", false, err
+	}
+	return username, password, true, nil
+}
+
+// readSOCKSRequest reads a SOCKS request and returns its destination.
+func readSOCKSRequest(r *bufio.Reader) (string, string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksCmdConnect {
+		return "", "", &socksError{socksCommandUnsupported, fmt.Errorf("unsupported SOCKS command %d", header[1])}
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		var err error
+		if host, err = readSOCKSString(r); err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", &socksError{socksAddressUnsupported, fmt.Errorf("unsupported SOCKS address type %d", header[3])}
+	}
+
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(port)), nil
+}
+
+// readSOCKSString reads a string prefixed by its length.
+func readSOCKSString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// socksReply sends a reply to a SOCKS request. The bound address is not
+// known for forwardings, so it is left empty.
+func socksReply(w io.Writer, reply byte) error {
+	_, err := w.Write([]byte{socksVersion, reply, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
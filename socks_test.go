@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTunnelKey(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	proxy := NewProxy()
+	proxy.viaSeparator = "--"
+
+	key, host, err := proxy.tunnelKey("db--bastion", "admin")
+	assert.NoError(err)
+	assert.Equal(clientKey{host: "bastion", port: 22, username: "admin"}, key)
+	assert.Equal("db", host)
+
+	key, host, err = proxy.tunnelKey("db.via.bastion", "admin")
+	assert.NoError(err)
+	assert.Equal(clientKey{host: "admin", port: 22}, key)
+	assert.Equal("db.via.bastion", host)
+
+	proxy.viaSeparator = ""
+	_, _, err = proxy.tunnelKey("db.via.bastion", "")
+	assert.ErrorIs(err, errJumpHostMissing)
+	assert.EqualError(err, "jump host missing, use the proxy username")
+}
+
+// socksDest encodes a SOCKS destination.
+func socksDest(addrType byte, host []byte, port int) []byte {
+	dest := []byte{addrType}
+	if addrType == socksAddrDomain {
+		dest = append(dest, byte(len(host)))
+	}
+	dest = append(dest, host...)
+	return binary.BigEndian.AppendUint16(dest, uint16(port))
+}
+
+// socksRequest sends a SOCKS request and returns the connection and the
+// reply code. The username and password are sent, if a username is given.
+func socksRequest(t *testing.T, addr, username, password string, cmd byte, dest []byte) (net.Conn, byte) {
+	t.Helper()
+	require := require.New(t)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(err)
+	t.Cleanup(func() { conn.Close() })
+	require.NoError(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+
+	method := byte(socksAuthNone)
+	if username != "" {
+		method = socksAuthPassword
+	}
+	_, err = conn.Write([]byte{socksVersion, 1, method})
+	require.NoError(err)
+
+	var buf [10]byte
+	_, err = io.ReadFull(conn, buf[:2])
+	require.NoError(err)
+	require.Equal([]byte{socksVersion, method}, buf[:2])
+
+	if username != "" {
+		auth := append([]byte{socksAuthVersion, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		_, err = conn.Write(auth)
+		require.NoError(err)
+
+		_, err = io.ReadFull(conn, buf[:2])
+		require.NoError(err)
+		require.Equal([]byte{socksAuthVersion, socksSucceeded}, buf[:2])
+	}
+
+	_, err = conn.Write(append([]byte{socksVersion, cmd, 0}, dest...))
+	require.NoError(err)
+
+	_, err = io.ReadFull(conn, buf[:])
+	require.NoError(err)
+	return conn, buf[1]
+}
+
+func TestSOCKS(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	// echo server
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	echoPort := echoListener.Addr().(*net.TCPAddr).Port
+
+	// unused port
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	closedPort := closedListener.Addr().(*net.TCPAddr).Port
+	closedListener.Close()
+
+	proxy := newJumpHostProxy(t)
+	defer proxy.close()
+
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer socksListener.Close()
+	go proxy.serveSOCKS(socksListener)
+	addr := socksListener.Addr().String()
+
+	echo := func(conn net.Conn) {
+		_, err := conn.Write([]byte("ping"))
+		require.NoError(err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(err)
+		assert.Equal("ping", string(buf))
+	}
+
+	// jump host as username
+	conn, reply := socksRequest(t, addr, "jump", "", socksCmdConnect, socksDest(socksAddrIPv4, net.IPv4(127, 0, 0, 1).To4(), echoPort))
+	require.EqualValues(socksSucceeded, reply)
+	echo(conn)
+
+	// jump host appended to the destination
+	conn, reply = socksRequest(t, addr, "", "", socksCmdConnect, socksDest(socksAddrDomain, []byte("127.0.0.1.via.jump"), echoPort))
+	require.EqualValues(socksSucceeded, reply)
+	echo(conn)
+
+	// HTTP request through the same jump host
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello World")
+	}))
+	defer upstream.Close()
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://jump/"+upstream.Listener.Addr().String()+"/", nil))
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("Hello World", w.Body.String())
+
+	// all use the same SSH connection
+	require.Len(proxy.clients, 1)
+	assert.Len(proxy.clients[clientKey{host: "jump", port: 22}].conns, 1)
+
+	// jump host missing
+	_, reply = socksRequest(t, addr, "", "", socksCmdConnect, socksDest(socksAddrIPv6, net.IPv6loopback, echoPort))
+	assert.EqualValues(socksNotAllowed, reply)
+
+	// BIND
+	_, reply = socksRequest(t, addr, "jump", "", 2, socksDest(socksAddrIPv4, net.IPv4(127, 0, 0, 1).To4(), echoPort))
+	assert.EqualValues(socksCommandUnsupported, reply)
+
+	// destination unreachable
+	_, reply = socksRequest(t, addr, "jump", "", socksCmdConnect, socksDest(socksAddrIPv4, net.IPv4(127, 0, 0, 1).To4(), closedPort))
+	assert.EqualValues(socksConnectionRefused, reply)
+}
+
+func TestSOCKSShutdown(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	port := upstream.Listener.Addr().(*net.TCPAddr).Port
+
+	newProxy := func() *Proxy { return newJumpHostProxy(t) }
+	testTunnelShutdown(t, newProxy, func(proxy *Proxy, _ *httptest.Server) net.Conn {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			proxy.serveSOCKS(listener)
+		}()
+
+		conn, reply := socksRequest(t, listener.Addr().String(), "jump", "", socksCmdConnect, socksDest(socksAddrIPv4, []byte{127, 0, 0, 1}, port))
+		require.Equal(byte(socksSucceeded), reply)
+
+		// stop accepting connections, like main before the shutdown
+		listener.Close()
+		<-served
+		return conn
+	})
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maximum nesting of Include directives and ProxyJump chains.
+const maxSSHConfigDepth = 16
+
+// sshHostConfig holds the settings of an OpenSSH client configuration
+// which apply to a single host.
+type sshHostConfig struct {
+	HostName      string
+	User          string
+	Port          uint16
+	IdentityFiles []string
+	ProxyJump     string
+}
+
+// sshConfigBlock is a "Host" block of an OpenSSH client configuration.
+type sshConfigBlock struct {
+	patterns []string
+	params   []sshConfigParam
+}
+
+type sshConfigParam struct {
+	keyword string // lower case
+	value   string
+}
+
+// openSSHConfig is a parsed OpenSSH client configuration (ssh_config(5)).
+// Only the keywords of sshHostConfig are evaluated, "Match" blocks are
+// ignored.
+type openSSHConfig struct {
+	dir    string // base directory for relative Include paths
+	blocks []*sshConfigBlock
+}
+
+// readSSHConfig reads an OpenSSH client configuration file. A missing
+// file results in an empty configuration.
+func readSSHConfig(file string) (*openSSHConfig, error) {
+	config := &openSSHConfig{dir: filepath.Dir(file)}
+
+	err := config.include(file, &sshConfigBlock{patterns: []string{"*"}}, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// include parses a file. Parameters before the first Host keyword belong
+// to the given block.
+func (config *openSSHConfig) include(file string, block *sshConfigBlock, depth int) error {
+	if depth > maxSSHConfigDepth {
+		return fmt.Errorf("%s: too many nested includes", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config.blocks = append(config.blocks, block)
+
+	return config.parse(f, file, block, depth)
+}
+
+func (config *openSSHConfig) parse(r io.Reader, file string, block *sshConfigBlock, depth int) error {
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		keyword, args, err := splitSSHConfigLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", file, lineNo, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("%s:%d: missing argument for %s", file, lineNo, keyword)
+		}
+
+		switch keyword {
+		case "host":
+			block = &sshConfigBlock{patterns: args}
+			config.blocks = append(config.blocks, block)
+		case "match":
+			// not supported, ignore the whole block
+			block = &sshConfigBlock{}
+			config.blocks = append(config.blocks, block)
+		case "include":
+			if block.patterns == nil {
+				continue // inside a Match block
+			}
+			if err := config.includeGlobs(args, block, depth); err != nil {
+				return fmt.Errorf("%s:%d: %w", file, lineNo, err)
+			}
+			// continue the current block after the included files
+			block = &sshConfigBlock{patterns: block.patterns}
+			config.blocks = append(config.blocks, block)
+		default:
+			block.params = append(block.params, sshConfigParam{
+				keyword: keyword,
+				value:   strings.Join(args, " "),
+			})
+		}
+	}
+	return scanner.Err()
+}
+
+func (config *openSSHConfig) includeGlobs(patterns []string, block *sshConfigBlock, depth int) error {
+	for _, pattern := range patterns {
+		pattern = expandHome(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(config.dir, pattern)
+		}
+
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			nested := &sshConfigBlock{patterns: block.patterns}
+			if err := config.include(file, nested, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitSSHConfigLine splits a line into the lower case keyword and its
+// arguments. Keyword and arguments are separated by whitespace or an
+// optional "=", arguments may be enclosed in double quotes.
+func splitSSHConfigLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", nil, nil
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i == -1 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:i])
+	rest := strings.TrimSpace(line[i:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	var args []string
+	for rest != "" {
+		var arg string
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				return "", nil, errors.New("unterminated quoted string")
+			}
+			arg, rest = rest[1:end+1], rest[end+2:]
+		} else if end := strings.IndexAny(rest, " \t"); end != -1 {
+			arg, rest = rest[:end], rest[end:]
+		} else {
+			arg, rest = rest, ""
+		}
+		args = append(args, arg)
+		rest = strings.TrimSpace(rest)
+	}
+
+	return keyword, args, nil
+}
+
+// matches checks whether the host matches the patterns of the block.
+func (block *sshConfigBlock) matches(host string) bool {
+	matched := false
+	for _, pattern := range block.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// lookup returns the settings for the given host alias. As with OpenSSH,
+// the first obtained value for each parameter is used, identity files are
+// accumulated.
+func (config *openSSHConfig) lookup(alias string) sshHostConfig {
+	var hc sshHostConfig
+	if config == nil {
+		return hc
+	}
+
+	host := strings.ToLower(alias)
+	for _, block := range config.blocks {
+		if !block.matches(host) {
+			continue
+		}
+
+		for _, param := range block.params {
+			switch param.keyword {
+			case "hostname":
+				if hc.HostName == "" {
+					hc.HostName = strings.ReplaceAll(param.value, "%h", alias)
+				}
+			case "user":
+				if hc.User == "" {
+					hc.User = param.value
+				}
+			case "port":
+				if hc.Port == 0 {
+					if port, err := strconv.ParseUint(param.value, 10, 16); err == nil {
+						hc.Port = uint16(port)
+					}
+				}
+			case "identityfile":
+				hc.IdentityFiles = append(hc.IdentityFiles, param.value)
+			case "proxyjump":
+				if hc.ProxyJump == "" {
+					hc.ProxyJump = param.value
+				}
+			}
+		}
+	}
+
+	return hc
+}
+
+// jump returns the canonical chain of jump hosts configured via ProxyJump
+// for the given host alias. As with OpenSSH, the ProxyJump setting of the
+// first jump host is applied as well.
+func (config *openSSHConfig) jump(alias string, depth int) (string, error) {
+	proxyJump := config.lookup(alias).ProxyJump
+	if proxyJump == "" || proxyJump == "none" {
+		return "", nil
+	}
+	if depth > maxSSHConfigDepth {
+		return "", fmt.Errorf("ProxyJump loop for %s", alias)
+	}
+
+	var jump string
+	for i, hop := range strings.Split(proxyJump, ",") {
+		key, err := parseHop(strings.TrimPrefix(hop, "ssh://"))
+		if err != nil {
+			return "", fmt.Errorf("invalid ProxyJump for %s: %w", alias, err)
+		}
+		if i == 0 {
+			key.jump, err = config.jump(key.host, depth+1)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			key.jump = jump
+		}
+		jump = key.String()
+	}
+	return jump, nil
+}
+
+// expandTokens expands the tokens of an IdentityFile value.
+func (hc *sshHostConfig) expandTokens(value, alias, user string) string {
+	host := hc.HostName
+	if host == "" {
+		host = alias
+	}
+
+	value = expandHome(value)
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", home,
+		"%h", host,
+		"%n", alias,
+		"%r", user,
+	).Replace(value)
+}
+
+// expandHome replaces a leading "~/" with the home directory.
+func expandHome(file string) string {
+	if rest, ok := strings.CutPrefix(file, "~/"); ok {
+		return filepath.Join(home, rest)
+	}
+	return file
+}
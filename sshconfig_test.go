@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSSHConfig(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0o700))
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	}
+	return filepath.Join(dir, "config")
+}
+
+func TestReadSSHConfig(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	file := writeSSHConfig(t, map[string]string{
+		"config": `
+# comment
+Include conf.d/*
+
+Host web web.example.com
+  HostName web.internal
+  Port 2222
+  IdentityFile "~/.ssh/web key"
+
+Host *.example.com !bad.example.com
+  User=admin
+  ProxyJump bastion
+
+Match user root
+  User nobody
+
+Host *
+  User prometheus
+  IdentityFile %d/.ssh/id_%h
+`,
+		"conf.d/bastion": `
+Host bastion
+  HostName bastion.example.com
+  ProxyJump none
+`,
+	})
+
+	config, err := readSSHConfig(file)
+	require.NoError(err)
+
+	assert.Equal(sshHostConfig{
+		HostName:      "web.internal",
+		User:          "prometheus",
+		Port:          2222,
+		IdentityFiles: []string{"~/.ssh/web key", "%d/.ssh/id_%h"},
+	}, config.lookup("web"))
+
+	assert.Equal(sshHostConfig{
+		HostName:      "web.internal",
+		User:          "admin",
+		Port:          2222,
+		IdentityFiles: []string{"~/.ssh/web key", "%d/.ssh/id_%h"},
+		ProxyJump:     "bastion",
+	}, config.lookup("WEB.example.com"))
+
+	assert.Equal(sshHostConfig{
+		User:          "prometheus",
+		IdentityFiles: []string{"%d/.ssh/id_%h"},
+	}, config.lookup("bad.example.com"))
+
+	assert.Equal(sshHostConfig{
+		HostName:      "bastion.example.com",
+		User:          "prometheus",
+		IdentityFiles: []string{"%d/.ssh/id_%h"},
+		ProxyJump:     "none",
+	}, config.lookup("bastion"))
+}
+
+func TestReadSSHConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	config, err := readSSHConfig("does-not-exist")
+	assert.NoError(t, err)
+	assert.Equal(t, sshHostConfig{}, config.lookup("example.com"))
+
+	file := writeSSHConfig(t, map[string]string{"config": "Host foo\n  HostName\n"})
+	_, err = readSSHConfig(file)
+	assert.EqualError(t, err, file+":2: missing argument for hostname")
+
+	file = writeSSHConfig(t, map[string]string{"config": "Include config\n"})
+	_, err = readSSHConfig(file)
+	assert.ErrorContains(t, err, "too many nested includes")
+}
+
+func TestSSHConfigJump(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	file := writeSSHConfig(t, map[string]string{
+		"config": `
+Host inner
+  ProxyJump admin@gateway:2200,ssh://middle
+
+Host gateway
+  ProxyJump bastion
+
+Host loop1
+  ProxyJump loop2
+
+Host loop2
+  ProxyJump loop1
+`,
+	})
+
+	config, err := readSSHConfig(file)
+	require.NoError(err)
+
+	jump, err := config.jump("inner", 0)
+	require.NoError(err)
+	assert.Equal("bastion:22,admin@gateway:2200,middle:22", jump)
+
+	jump, err = config.jump("bastion", 0)
+	require.NoError(err)
+	assert.Empty(jump)
+
+	_, err = config.jump("loop1", 0)
+	assert.ErrorContains(err, "ProxyJump loop")
+}
+
+func TestExpandTokens(t *testing.T) {
+	t.Parallel()
+
+	hc := sshHostConfig{HostName: "web.internal"}
+	assert.Equal(t,
+		filepath.Join(home, "keys/web.internal-admin-web%"),
+		hc.expandTokens("~/keys/%h-%r-%n%%", "web", "admin"),
+	)
+}
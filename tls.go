@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+)
+
+// tlsSettings configures TLS connections to destination hosts.
+type tlsSettings struct {
+	Host               string `json:"host"` // hostname pattern, see path.Match
+	CA                 string `json:"ca"`   // PEM file with trusted CA certificates
+	Cert               string `json:"cert"` // PEM file with the client certificate
+	Key                string `json:"key"`  // PEM file with the client key
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+type tlsConfig struct {
+	pattern string
+	config  *tls.Config
+}
+
+// tlsConfigs holds TLS configurations for destination hosts. The first
+// matching entry wins.
+type tlsConfigs []tlsConfig
+
+// loadTLSConfigs reads a JSON file containing a list of tlsSettings.
+func loadTLSConfigs(file string) (tlsConfigs, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []tlsSettings
+	if err := json.Unmarshal(buf, &settings); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", file, err)
+	}
+
+	configs := make(tlsConfigs, 0, len(settings))
+	for _, s := range settings {
+		config, err := s.build()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for %q: %w", s.Host, err)
+		}
+		configs = append(configs, tlsConfig{pattern: s.Host, config: config})
+	}
+	return configs, nil
+}
+
+// build creates a tls.Config from the settings.
+func (s *tlsSettings) build() (*tls.Config, error) {
+	if _, err := path.Match(s.Host, ""); err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if s.CA != "" {
+		pem, err := os.ReadFile(s.CA)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", s.CA)
+		}
+	}
+
+	if s.Cert != "" || s.Key != "" {
+		if s.Cert == "" || s.Key == "" {
+			return nil, errors.New("client certificate requires both cert and key")
+		}
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// forHost returns the TLS configuration for the given destination host.
+func (configs tlsConfigs) forHost(host string) *tls.Config {
+	var config *tls.Config
+	for _, c := range configs {
+		if ok, _ := path.Match(c.pattern, host); ok {
+			config = c.config.Clone()
+			break
+		}
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTLSConfigs(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "tls.json")
+	require.NoError(os.WriteFile(file, []byte(`[
+		{"host": "*.insecure.example.com", "insecure_skip_verify": true},
+		{"host": "*.example.com", "server_name": "exporter.example.com"}
+	]`), 0o600))
+
+	configs, err := loadTLSConfigs(file)
+	require.NoError(err)
+	require.Len(configs, 2)
+
+	config := configs.forHost("a.insecure.example.com")
+	assert.True(config.InsecureSkipVerify)
+	assert.Equal("a.insecure.example.com", config.ServerName)
+
+	config = configs.forHost("b.example.com")
+	assert.False(config.InsecureSkipVerify)
+	assert.Equal("exporter.example.com", config.ServerName)
+
+	config = configs.forHost("localhost")
+	assert.False(config.InsecureSkipVerify)
+	assert.Equal("localhost", config.ServerName)
+}
+
+func TestTLSSettingsBuild(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		settings      tlsSettings
+		expectedError string
+	}{
+		{
+			name:          "invalid pattern",
+			settings:      tlsSettings{Host: "["},
+			expectedError: "syntax error in pattern",
+		},
+		{
+			name:          "missing CA file",
+			settings:      tlsSettings{Host: "*", CA: "does-not-exist"},
+			expectedError: "open does-not-exist: no such file or directory",
+		},
+		{
+			name:          "CA file without certificates",
+			settings:      tlsSettings{Host: "*", CA: "fixtures/id_ed25519.pub"},
+			expectedError: "no certificates found in fixtures/id_ed25519.pub",
+		},
+		{
+			name:          "certificate without key",
+			settings:      tlsSettings{Host: "*", Cert: "cert.pem"},
+			expectedError: "client certificate requires both cert and key",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := test.settings.build()
+			assert.EqualError(t, err, test.expectedError)
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trackTunnel registers a tunnel, which is not seen by http.Server.Shutdown,
+// until the returned function is called. HTTP handlers must call it before
+// hijacking the connection.
+func (proxy *Proxy) trackTunnel() func() {
+	proxy.tunnels.Add(1)
+	return proxy.tunnels.Done
+}
+
+// waitTunnels waits for all tracked tunnels to finish or ctx to be done.
+func (proxy *Proxy) waitTunnels(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		proxy.tunnels.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pipe connects the client connection with the forwarded connection in
+// both directions, until either side closes it or no data is transferred
+// for the idle timeout (0 to disable). Data from the client is read from
+// r, which may hold data already received. The transferred bytes are
+// added to stats. It reports whether the idle timeout has passed.
+func pipe(conn net.Conn, r io.Reader, backend io.ReadWriteCloser, timeout time.Duration, stats *byteStats) bool {
+	var once sync.Once
+	closeAll := func() {
+		once.Do(func() {
+			conn.Close()
+			backend.Close()
+		})
+	}
+
+	var idle atomic.Bool
+	active := func() {}
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			idle.Store(true)
+			closeAll()
+		})
+		defer timer.Stop()
+		active = func() { timer.Reset(timeout) }
+	}
+
+	done := make(chan struct{})
+	go func() {
+		splice(backend, r, &stats.sent, active)
+		closeAll()
+		close(done)
+	}()
+	splice(conn, backend, &stats.received, active)
+	closeAll()
+	<-done
+
+	return idle.Load()
+}
+
+// splice copies from src to dst until either fails and adds the number of
+// bytes to the counter.
+func splice(dst io.Writer, src io.Reader, counter *uint64, active func()) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			active()
+			atomic.AddUint64(counter, uint64(n))
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
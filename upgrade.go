@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// upgradeType returns the protocol of the Upgrade header, if the
+// Connection header asks for an upgrade.
+func upgradeType(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for token := range strings.SplitSeq(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// serveUpgrade passes the response switching protocols to the client and
+// splices the client connection with the forwarded connection, until
+// either side closes it or no data is transferred for the idle timeout.
+func (proxy *Proxy) serveUpgrade(w http.ResponseWriter, res *http.Response, upgrade string) {
+	backend, ok := res.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(upgradeType(res.Header), upgrade) {
+		res.Body.Close()
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "unexpected switch to protocol %q\n", res.Header.Get("Upgrade"))
+		return
+	}
+	defer backend.Close()
+
+	defer proxy.trackTunnel()()
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err)
+		return
+	}
+	defer conn.Close()
+
+	copyHeader(w.Header(), res.Header)
+	res.Header = w.Header()
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		return
+	}
+
+	if pipe(conn, brw.Reader, backend, proxy.upgradeIdleTimeout, &metrics.upgrades) {
+		log.Printf("%s connection to %s closed after being idle", upgrade, res.Request.URL.Host)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestUpgradeType(t *testing.T) {
+	t.Parallel()
+
+	assert := assert.New(t)
+
+	header := http.Header{}
+	assert.Empty(upgradeType(header))
+
+	header.Set("Upgrade", "websocket")
+	assert.Empty(upgradeType(header))
+
+	header.Set("Connection", "keep-alive, Upgrade")
+	assert.Equal("websocket", upgradeType(header))
+
+	header.Set("Connection", "upgrade")
+	assert.Equal("websocket", upgradeType(header))
+}
+
+// startEchoServer starts a server echoing data after switching to the
+// "echo" protocol.
+func startEchoServer(t *testing.T) *httptest.Server {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+func TestUpgrade(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	sshPort := startSSHServer(t, config)
+
+	upstream := startEchoServer(t)
+
+	proxy := newTestProxy()
+	proxy.upgradeIdleTimeout = 200 * time.Millisecond
+	defer proxy.close()
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	sent := atomic.LoadUint64(&metrics.upgrades.sent)
+	received := atomic.LoadUint64(&metrics.upgrades.received)
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	require.NoError(conn.SetDeadline(time.Now().Add(5 * time.Second)))
+
+	fmt.Fprintf(conn, "GET http://127.0.0.1:%d/%s/ HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nping", sshPort, upstream.Listener.Addr())
+
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	require.NoError(err)
+	assert.Equal(http.StatusSwitchingProtocols, res.StatusCode)
+	assert.Equal("echo", res.Header.Get("Upgrade"))
+
+	// data sent along with the request and afterwards
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(err)
+	assert.Equal("ping", string(buf))
+
+	fmt.Fprint(conn, "pong")
+	_, err = io.ReadFull(r, buf)
+	require.NoError(err)
+	assert.Equal("pong", string(buf))
+
+	assert.GreaterOrEqual(atomic.LoadUint64(&metrics.upgrades.sent)-sent, uint64(8))
+	assert.GreaterOrEqual(atomic.LoadUint64(&metrics.upgrades.received)-received, uint64(8))
+
+	// closed after being idle
+	start := time.Now()
+	_, err = r.ReadByte()
+	assert.ErrorIs(err, io.EOF)
+	assert.Less(time.Since(start), 2*time.Second)
+}
+
+func TestUpgradeShutdown(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	sshPort := startSSHServer(t, config)
+	upstream := startEchoServer(t)
+
+	testTunnelShutdown(t, newTestProxy, func(proxy *Proxy, server *httptest.Server) net.Conn {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(err)
+
+		fmt.Fprintf(conn, "GET http://127.0.0.1:%d/%s/ HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", sshPort, upstream.Listener.Addr())
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(err)
+		require.Equal(http.StatusSwitchingProtocols, res.StatusCode)
+		return conn
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// interval for checking whether pre-warmed connections are still up.
+const warmCheckInterval = time.Second
+
+// readWarmHosts reads hosts to keep connected from a file, one per line.
+// Empty lines and comments are ignored.
+func readWarmHosts(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && line[0] != '#' {
+			hosts = append(hosts, line)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// warm connects to the given hosts in the background and keeps them
+// connected. The clients are never released, so they are not reaped.
+func (proxy *Proxy) warm(keys []clientKey) {
+	clients := make([]*client, 0, len(keys))
+	for _, key := range keys {
+		log.Printf("keeping SSH connection to %s", key.String())
+		clients = append(clients, proxy.getClient(key))
+	}
+
+	proxy.mtx.Lock()
+	proxy.warmClients = append(proxy.warmClients, clients...)
+	proxy.mtx.Unlock()
+
+	for _, client := range clients {
+		go client.keepWarm(warmCheckInterval)
+	}
+}
+
+// keepWarm establishes the SSH connection whenever it is down, until the
+// proxy is closed. Failed attempts are subject to the circuit breaker.
+func (client *client) keepWarm(interval time.Duration) {
+	ctx, cancel := client.proxy.context()
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if !client.isConnected() {
+			if conn, err := client.acquire(ctx); err == nil {
+				client.release(conn)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ServeReady reports whether all pre-warmed hosts are connected.
+func (proxy *Proxy) ServeReady(w http.ResponseWriter, _ *http.Request) {
+	proxy.mtx.Lock()
+	clients := proxy.warmClients
+	proxy.mtx.Unlock()
+
+	var down []string
+	for _, client := range clients {
+		if !client.isConnected() {
+			down = append(down, client.key.String())
+		}
+	}
+
+	if len(down) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not connected: %s\n", strings.Join(down, " "))
+		return
+	}
+	fmt.Fprintf(w, "ready, %d hosts connected\n", len(clients))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestReadWarmHosts(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "warm")
+	require.NoError(t, os.WriteFile(file, []byte("# jump hosts\nbastion\n\n  admin@bastion,inner  \n"), 0o600))
+
+	hosts, err := readWarmHosts(file)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bastion", "admin@bastion,inner"}, hosts)
+}
+
+func TestWarm(t *testing.T) {
+	t.Parallel()
+
+	require := require.New(t)
+	assert := assert.New(t)
+
+	var handshakes atomic.Int32
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			handshakes.Add(1)
+			return nil, nil
+		},
+	}
+	sshPort := startSSHServer(t, config)
+
+	proxy := newTestProxy()
+	defer proxy.close()
+
+	ready := func() int {
+		w := httptest.NewRecorder()
+		proxy.ServeReady(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+		return w.Code
+	}
+
+	key := clientKey{host: "127.0.0.1", port: sshPort, password: "secret"}
+	unreachable := clientKey{host: "127.0.0.1", port: 1}
+
+	proxy.warm([]clientKey{key})
+	assert.Eventually(func() bool { return ready() == http.StatusOK }, time.Second, 10*time.Millisecond)
+	assert.EqualValues(1, handshakes.Load())
+
+	// never reaped
+	proxy.reapIdleClients(0)
+	require.Contains(proxy.clients, key)
+	client := proxy.clients[key]
+
+	// reconnected in the background
+	client.close()
+	assert.Equal(http.StatusServiceUnavailable, ready())
+	assert.Eventually(func() bool { return ready() == http.StatusOK }, 3*time.Second, 10*time.Millisecond)
+	assert.EqualValues(2, handshakes.Load())
+
+	proxy.warm([]clientKey{unreachable})
+	w := httptest.NewRecorder()
+	proxy.ServeReady(w, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal("not connected: 127.0.0.1:1\n", w.Body.String())
+}